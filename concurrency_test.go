@@ -0,0 +1,111 @@
+package postdock
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeServerPsql writes a psql script which keeps a database per file in
+// state, enough for Create and Drop, and returns its path.
+func fakeServerPsql(t testing.TB, state string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "psql")
+	script := `#!/bin/sh
+state=` + quote(state) + `
+for q; do :; done
+case "$q" in
+*"FROM pg_database WHERE datname = '"*)
+	db=${q#*datname = \'}
+	db=${db%%\'*}
+	v=f
+	[ -e "$state/$db" ] && v=t
+	printf 'exists\n%s\n(1 row)\n' "$v" ;;
+*"SELECT EXISTS"*)
+	printf 'exists\nt\n(1 row)\n' ;;
+*server_version_num*)
+	printf 'server_version_num\n160000\n(1 row)\n' ;;
+*pg_terminate_backend*)
+	printf 'count\n0\n(1 row)\n' ;;
+"CREATE DATABASE "*)
+	db=${q#CREATE DATABASE }
+	touch "$state/${db%% *}"
+	echo "CREATE DATABASE" ;;
+"DROP DATABASE IF EXISTS "*)
+	db=${q#DROP DATABASE IF EXISTS }
+	rm -f "$state/${db%;}"
+	echo "DROP DATABASE" ;;
+esac
+`
+	if err := ioutil.WriteFile(p, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// TestConcurrentCreateDrop runs Create and Drop of several databases from
+// many goroutines with one shared Options, Hook and Metrics, to be run with
+// -race.
+func TestConcurrentCreateDrop(t *testing.T) {
+	state := t.TempDir()
+	opt := testOptions()
+	opt.PsqlPath = fakeServerPsql(t, state)
+	opt.Schemas = []string{"app"}
+	opt.Variables = map[string]string{"tenant": "a"}
+	opt.Volumes = make([]string, 0, 8)
+	hook := &recordingHook{}
+	opt.Hook = hook
+	opt.Metrics = &Metrics{}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for i := 0; i < 8; i++ {
+		dbName := fmt.Sprintf("db_%d", i%4)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 3; j++ {
+				if err := Create(dbName, opt); err != nil {
+					errs <- err
+				}
+				if err := Drop(dbName, opt); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// A Create may have run after the last Drop of another goroutine.
+	for i := 0; i < 4; i++ {
+		if err := Drop(fmt.Sprintf("db_%d", i), opt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	left, err := ioutil.ReadDir(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("%d databases left after dropping all of them", len(left))
+	}
+	created := 0
+	for _, e := range hook.commands {
+		if strings.Contains(e.Command, "CREATE DATABASE") {
+			created++
+		}
+	}
+	if created == 0 {
+		t.Error("no database was created")
+	}
+	if s := opt.Metrics.Snapshot(); s.OpsCounts["Create"] != 24 || s.OpsCounts["Drop"] != 28 {
+		t.Errorf("counted %d creates and %d drops, want 24 and 28", s.OpsCounts["Create"], s.OpsCounts["Drop"])
+	}
+}
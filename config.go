@@ -0,0 +1,43 @@
+package postdock
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// LoadOptions reads Options from a JSON file, keyed by the json tags of
+// Options, e.g.
+//
+//	{"docker_image": "postgres:12-alpine", "db_host": "localhost", "db_user": "app"}
+//
+// Unknown keys are an error, to catch typos. Durations such as timeout are in
+// nanoseconds, and Hook, Metrics, DumpFilter and OnOutput can only be set in
+// code. The password is resolved, see Options.ResolvePassword, and the loaded
+// Options are validated for DBName, or the maintenance database if unset.
+func LoadOptions(path string) (Options, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Options{}, err
+	}
+
+	var opt Options
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&opt); err != nil {
+		return Options{}, fmt.Errorf("postdock: %s: %w", path, err)
+	}
+
+	if opt, err = opt.ResolvePassword(); err != nil {
+		return Options{}, err
+	}
+	dbName := opt.DBName
+	if dbName == "" {
+		dbName = "postgres"
+	}
+	if err := opt.isValid(dbName); err != nil {
+		return Options{}, fmt.Errorf("%w (in %s)", err, path)
+	}
+	return opt, nil
+}
@@ -0,0 +1,35 @@
+package postdock
+
+import (
+	"go/parser"
+	"go/token"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestLoadOptionsDoc keeps the LoadOptions doc in line with the Options
+// fields that are skipped by encoding/json.
+func TestLoadOptionsDoc(t *testing.T) {
+	f, err := parser.ParseFile(token.NewFileSet(), "config.go", nil, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc string
+	for _, d := range f.Comments {
+		if strings.HasPrefix(d.Text(), "LoadOptions ") {
+			doc = strings.Join(strings.Fields(d.Text()), " ")
+		}
+	}
+	if doc == "" {
+		t.Fatal("no LoadOptions doc in config.go")
+	}
+
+	typ := reflect.TypeOf(Options{})
+	for i := 0; i < typ.NumField(); i++ {
+		fld := typ.Field(i)
+		if fld.Tag.Get("json") == "-" && !strings.Contains(doc, fld.Name) {
+			t.Errorf("LoadOptions doc does not name %s as code only", fld.Name)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package postdock
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContainerFlagsQuoted(t *testing.T) {
+	opt := testOptions()
+	opt.ForceLocal, opt.ForceDocker = false, true
+	opt.KeepContainer = true
+	opt.ContainerName = "debug; touch /tmp/pwned"
+	opt.Hostname = "db $(id)"
+	out := dryRun(t, func(opt Options) error { _, err := Exec("db", []string{"SELECT 1"}, opt); return err }, opt)
+
+	for _, want := range []string{
+		"--name 'debug; touch /tmp/pwned' ",
+		"--hostname='db $(id)' ",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("command lacks %s:\n%s", want, out)
+		}
+	}
+}
+
+func TestNetworkFlagsQuoted(t *testing.T) {
+	opt := testOptions()
+	opt.ForceLocal, opt.ForceDocker = false, true
+	opt.DockerNetwork = "net --privileged"
+	opt.NetworkAlias = "db;rm -rf /"
+	out := dryRun(t, func(opt Options) error { _, err := Exec("db", []string{"SELECT 1"}, opt); return err }, opt)
+
+	for _, want := range []string{
+		"--network='net --privileged' ",
+		"--network-alias='db;rm -rf /' ",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("command lacks %s:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, " --privileged ") {
+		t.Errorf("network name passed as a flag:\n%s", out)
+	}
+}
@@ -0,0 +1,79 @@
+package postdock
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// CopyDatabase copies srcDB on the server of srcOpt to dstDB on the server of
+// dstOpt by piping pg_dump straight into psql, so the dump never lands on
+// disk. dstDB is dropped and created first, like Import, and ends up owned by
+// dstOpt.DBUser since ownership and privileges are not copied.
+//
+// Both commands run in a single container using the docker settings of
+// srcOpt, which must be able to reach both servers. Sessions on srcDB are
+// terminated first so no writes land after the snapshot of pg_dump, unless
+// srcOpt.SkipTerminate is set.
+func CopyDatabase(srcDB string, srcOpt Options, dstDB string, dstOpt Options) (err error) {
+	defer trace("CopyDatabase", srcDB, &srcOpt)(&err)
+
+	if err := srcOpt.isValid(srcDB); err != nil {
+		return err
+	}
+	if err := dstOpt.isValid(dstDB); err != nil {
+		return err
+	}
+	// The timeout of srcOpt covers the whole copy.
+	if dstOpt.deadline.IsZero() {
+		dstOpt.deadline = srcOpt.deadline
+	}
+	// Dropping the destination would otherwise drop the source.
+	src, dst := srcOpt.normalize(), dstOpt.normalize()
+	if src.DBHost == dst.DBHost && src.DBPort == dst.DBPort && srcDB == dstDB {
+		return errors.New("postdock: source and destination database are the same")
+	}
+
+	if !srcOpt.SkipTerminate {
+		err := Terminate(srcDB, srcOpt)
+		switch {
+		case errors.Is(err, ErrTerminatePermission):
+			// Still attempt the copy, pg_dump does not need exclusive access.
+			if srcOpt.Debug {
+				log.Printf("continuing to copy db:%s: %v", srcDB, err)
+			}
+		case err != nil:
+			return err
+		}
+	}
+	if err := Drop(dstDB, dstOpt); err != nil {
+		return err
+	}
+	if err := Create(dstDB, dstOpt); err != nil {
+		return err
+	}
+
+	// Both commands run with srcOpt, so a pgpass file must hold both
+	// credentials.
+	if srcOpt.UsePassFile || dstOpt.UsePassFile {
+		srcOpt.UsePassFile, dstOpt.UsePassFile = true, true
+		srcOpt.passFileEntries = append(append([]string(nil), srcOpt.passFileEntries...), pgpassEntry(dstOpt))
+	}
+	dump := pgDumpCmd(srcDB, srcOpt, "--no-owner", "--no-privileges")
+	restore := psqlCmd(dstDB, dstOpt)
+	// sh has no pipefail everywhere, so if pg_dump fails feed psql a failing
+	// statement to make the whole command fail.
+	fail := quote("DO $$ BEGIN RAISE EXCEPTION 'pg_dump failed'; END $$;")
+	cmd := fmt.Sprintf("(%s || echo %s) | %s", dump, fail, restore)
+
+	srcOpt.secrets = append(append([]string(nil), srcOpt.secrets...), dstOpt.DBPassword)
+	if _, err := run(cmd, srcOpt.bounded()); err != nil {
+		return err
+	}
+
+	if srcOpt.Debug {
+		log.Printf("successfully copied db:%s to db:%s on host:%s", srcDB, dstDB, dstOpt.DBHost)
+	}
+
+	return nil
+}
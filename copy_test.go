@@ -0,0 +1,23 @@
+package postdock
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCopyDatabaseTerminatesSource(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		hook := &recordingHook{}
+		opt := testOptions()
+		opt.DryRun = true
+		opt.SkipTerminate = skip
+		opt.Hook = hook
+		if err := CopyDatabase("src", opt, "dst", opt); err != nil {
+			t.Fatal(err)
+		}
+		events := strings.Join(hook.events, ",")
+		if got := strings.Contains(events, "start Terminate src"); got == skip {
+			t.Errorf("SkipTerminate=%v: terminated src = %v, events %s", skip, got, events)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package postdock
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// copyPath is a file or directory on the host which runCopied copies into
+// the container instead of bind mounting it, see Options.CopyFiles.
+type copyPath struct {
+	host      string
+	container string
+	// dir is copied back to the host after the command succeeded, e.g. with
+	// the output of a dump.
+	dir bool
+}
+
+// splitVolume splits a volume as returned by volume or mountDir into the host
+// and container paths.
+func splitVolume(v string) copyPath {
+	i := strings.LastIndex(v, ":/")
+	return copyPath{host: v[:i], container: v[i+1:], dir: true}
+}
+
+// runCopied runs cmd like runInput, but in a container which is created
+// first, so paths can be copied into it with docker cp, then started, and
+// removed afterwards unless o.KeepContainer is set. flags are those of docker
+// run, without --rm.
+func runCopied(flags []string, paths []copyPath, cmd string, input io.Reader, o Options) (string, error) {
+	create := fmt.Sprintf("docker create %s %s %s -c %s",
+		strings.Join(flags, " "), o.DockerImage, quote(o.normalize().Shell), quote(cmd))
+	if o.DryRun {
+		log.Printf("dry run:\n%s", redact(create, o))
+		for _, p := range paths {
+			log.Printf("dry run:\ndocker cp --archive - <container>:/ # %s to %s", p.host, p.container)
+		}
+		log.Printf("dry run:\ndocker start --attach <container>")
+		return "", nil
+	}
+	if o.Debug {
+		logCommand(create, flags, paths, o)
+	}
+
+	id, err := dockerStep(create, nil, o)
+	if err != nil {
+		return "", err
+	}
+	if !o.KeepContainer {
+		defer func() {
+			if _, err := dockerStep("docker rm --force "+id, nil, o); err != nil && o.Debug {
+				log.Printf("failed to remove container %s: %v", id, err)
+			}
+		}()
+	}
+
+	for _, p := range paths {
+		if err := copyToContainer(id, p, o); err != nil {
+			return "", err
+		}
+	}
+	start := "docker start --attach " + id
+	if input != nil {
+		start = "docker start --attach --interactive " + id
+	}
+	// The only step running the command of the caller, so the only one
+	// subject to OnOutput, BusyRetries and IgnoreErrors.
+	out, err := execute(start, input, o)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range paths {
+		if !p.dir {
+			continue
+		}
+		// The trailing /. copies the content into the existing directory.
+		src := quote(id + ":" + p.container + "/.")
+		if _, err := dockerStep("docker cp "+src+" "+quote(p.host), nil, o); err != nil {
+			return "", err
+		}
+	}
+
+	return out, nil
+}
+
+// dockerStep runs one of the docker commands managing the container of
+// runCopied and returns its trimmed output, or its output as the error if it
+// failed.
+func dockerStep(command string, input io.Reader, o Options) (string, error) {
+	out, failed, err := dockerCLI(command, input, o)
+	if err != nil {
+		return "", err
+	}
+	if failed {
+		return "", rawError(out, o)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// copyToContainer copies p into the created container id, as a tar stream
+// which docker cp extracts at the root of the container. Missing parent
+// directories are created by docker, unlike when copying the path directly.
+func copyToContainer(id string, p copyPath, o Options) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeTar(pw, p, o))
+	}()
+	// The ownership in the archive is kept, see writeTar.
+	_, err := dockerStep("docker cp --archive - "+id+":/", pr, o)
+	pr.Close()
+	return err
+}
+
+// writeTar writes p to w as a tar archive with the container paths. The files
+// are owned by the user running the commands in the container, root unless
+// o.RunAsCurrentUser is set, so they can be read and written, e.g. a pgpass
+// file which must not be readable by others.
+func writeTar(w io.Writer, p copyPath, o Options) error {
+	uid, gid := 0, 0
+	if o.RunAsCurrentUser && os.Getuid() >= 0 {
+		uid, gid = os.Getuid(), os.Getgid()
+	}
+	root := strings.TrimPrefix(p.container, "/")
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(p.host, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(p.host, file)
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			// Sockets and the like have no tar header, and nothing to copy.
+			return nil
+		}
+		hdr.Name = path.Join(root, filepath.ToSlash(rel))
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uid, hdr.Gid = uid, gid
+		hdr.Uname, hdr.Gname = "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
@@ -0,0 +1,48 @@
+package postdock
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDocker puts a docker script running body first on the PATH.
+func fakeDocker(t *testing.T, body string) {
+	t.Helper()
+	dir := filepath.Dir(fakeScript(t, "docker", body))
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+}
+
+func TestRunCopiedDockerCpFails(t *testing.T) {
+	fakeDocker(t, `case "$1" in
+create) echo 0123abcd ;;
+cp) echo "Error response from daemon: ERROR: no such container" >&2; exit 1 ;;
+start) echo "INSERT 0 1" ;;
+esac`)
+	var mu sync.Mutex
+	var lines []string
+	opt := testOptions()
+	opt.ForceLocal, opt.ForceDocker = false, true
+	opt.PullPolicy = PullNever
+	opt.CopyFiles = true
+	opt.IgnoreErrors = []string{"42"}
+	opt.OnOutput = func(line string) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, line)
+	}
+
+	_, err := ImportWithOptions("db", "testdata/import.sql", ImportOptions{}, opt)
+	if err == nil || !strings.Contains(err.Error(), "no such container") {
+		t.Fatalf("got %v, want the docker cp error", err)
+	}
+	for _, line := range lines {
+		if strings.Contains(line, "no such container") {
+			t.Errorf("docker output passed to OnOutput: %s", line)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package postdock
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCreateOwnerDiffersFromUser(t *testing.T) {
+	opt := testOptions()
+	opt.DBUser = "bootstrap"
+	opt.DBOwner = "app"
+	out := dryRun(t, func(opt Options) error { return Create("appdb", opt) }, opt)
+
+	for _, want := range []string{
+		"CREATE USER bootstrap WITH PASSWORD",
+		"CREATE ROLE app;",
+		"CREATE DATABASE appdb ENCODING",
+		"TEMPLATE template0 OWNER app;",
+		`GRANT ALL PRIVILEGES ON ALL TABLES IN SCHEMA "public" TO app`,
+		`ALTER DEFAULT PRIVILEGES FOR ROLE app, bootstrap IN SCHEMA "public" GRANT ALL PRIVILEGES ON TABLES TO app`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Create did not run %q:\n%s", want, out)
+		}
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.Contains(line, "psql") && !strings.Contains(line, "-U bootstrap ") {
+			t.Errorf("command does not connect as DBUser: %s", line)
+		}
+		if strings.Contains(line, "OWNER bootstrap") || strings.Contains(line, "TO bootstrap") {
+			t.Errorf("DBUser instead of DBOwner used: %s", line)
+		}
+	}
+}
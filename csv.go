@@ -0,0 +1,60 @@
+package postdock
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// ImportCSV loads csvFile, which has a header line, into the existing table
+// of dbName with COPY and returns the number of rows loaded. table may be
+// schema qualified. columns optionally lists the table columns in the order
+// of the csv file, for a file with a subset of the columns or in a different
+// order. The file is streamed to psql over stdin, so no volume is mounted.
+func ImportCSV(dbName string, table string, csvFile string, columns []string, opt Options) (_ int64, err error) {
+	defer trace("ImportCSV", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return 0, err
+	}
+	if table == "" {
+		return 0, errors.New("postdock: required option: table")
+	}
+	if csvFile == "" {
+		return 0, errors.New("postdock: required option: csv file to import")
+	}
+
+	target := quoteIdent(table)
+	if len(columns) > 0 {
+		quoted := make([]string, 0, len(columns))
+		for _, c := range columns {
+			if c == "" {
+				return 0, errors.New("postdock: empty column name")
+			}
+			// Column names are never qualified, so quote dots as well.
+			quoted = append(quoted, `"`+strings.ReplaceAll(c, `"`, `""`)+`"`)
+		}
+		target += " (" + strings.Join(quoted, ", ") + ")"
+	}
+
+	f, err := os.Open(csvFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	q := fmt.Sprintf("COPY %s FROM STDIN WITH (FORMAT csv, HEADER)", target)
+	out, err := runInput(psqlCmd(dbName, opt, "-c", quote(q)), f, opt)
+	if err != nil {
+		return 0, err
+	}
+	n := newResult(out).RowsAffected
+
+	if opt.Debug {
+		log.Printf("successfully imported %d rows into %s of db:%s from %s", n, table, dbName, csvFile)
+	}
+
+	return n, nil
+}
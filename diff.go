@@ -0,0 +1,192 @@
+package postdock
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// SchemaMatches dumps the schema of dbName like SchemaDump and compares it to
+// file, e.g. a checked-in schema.sql, ignoring trailing whitespace and line
+// endings. On a mismatch it returns a unified diff from file to the live
+// schema, which makes it suitable as a schema drift check in CI.
+func SchemaMatches(dbName string, file string, opt Options) (_ bool, _ string, err error) {
+	defer trace("SchemaMatches", dbName, &opt)(&err)
+
+	if file == "" {
+		return false, "", errors.New("postdock: required option: schema file to compare")
+	}
+	want, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false, "", err
+	}
+	got, err := SchemaDump(dbName, "", opt)
+	if err != nil {
+		return false, "", err
+	}
+	if opt.DryRun {
+		return true, "", nil
+	}
+
+	a, b := normalizeLines(string(want)), normalizeLines(got)
+	if strings.Join(a, "\n") == strings.Join(b, "\n") {
+		return true, "", nil
+	}
+	return false, unifiedDiff(file, dbName, a, b), nil
+}
+
+// normalizeLines splits s into lines without line endings, trailing
+// whitespace or trailing empty lines.
+func normalizeLines(s string) []string {
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t\r")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLine is a line of a diff, kind is ' ' for context, '-' for a line only
+// in the old and '+' for a line only in the new version.
+type diffLine struct {
+	kind byte
+	text string
+}
+
+// maxDiffCells bounds the size of the table diffLines computes, beyond which
+// the differing lines are reported as replaced in full.
+const maxDiffCells = 1 << 22
+
+// diffLines returns the edits turning a into b, based on their longest common
+// subsequence after skipping a common prefix and suffix, which usually leaves
+// little to compare for similar schemas.
+func diffLines(a, b []string) []diffLine {
+	var prefix, suffix int
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var out []diffLine
+	for _, l := range a[:prefix] {
+		out = append(out, diffLine{' ', l})
+	}
+	x, y := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if (len(x)+1)*(len(y)+1) > maxDiffCells {
+		for _, l := range x {
+			out = append(out, diffLine{'-', l})
+		}
+		for _, l := range y {
+			out = append(out, diffLine{'+', l})
+		}
+	} else {
+		// lcs[i][j] is the length of the longest common subsequence of x[i:]
+		// and y[j:].
+		lcs := make([][]int, len(x)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(y)+1)
+		}
+		for i := len(x) - 1; i >= 0; i-- {
+			for j := len(y) - 1; j >= 0; j-- {
+				switch {
+				case x[i] == y[j]:
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				case lcs[i+1][j] >= lcs[i][j+1]:
+					lcs[i][j] = lcs[i+1][j]
+				default:
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(x) || j < len(y) {
+			switch {
+			case i < len(x) && j < len(y) && x[i] == y[j]:
+				out = append(out, diffLine{' ', x[i]})
+				i++
+				j++
+			case j == len(y) || (i < len(x) && lcs[i+1][j] >= lcs[i][j+1]):
+				out = append(out, diffLine{'-', x[i]})
+				i++
+			default:
+				out = append(out, diffLine{'+', y[j]})
+				j++
+			}
+		}
+	}
+	for _, l := range a[len(a)-suffix:] {
+		out = append(out, diffLine{' ', l})
+	}
+	return out
+}
+
+// unifiedDiff formats the differences between a and b as a unified diff
+// with three lines of context.
+func unifiedDiff(aName, bName string, a, b []string) string {
+	const context = 3
+	lines := diffLines(a, b)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", aName, bName)
+	// aLine and bLine are the line numbers, starting at 0, before lines[i].
+	aLine := make([]int, len(lines)+1)
+	bLine := make([]int, len(lines)+1)
+	for i, l := range lines {
+		aLine[i+1], bLine[i+1] = aLine[i], bLine[i]
+		if l.kind != '+' {
+			aLine[i+1]++
+		}
+		if l.kind != '-' {
+			bLine[i+1]++
+		}
+	}
+	for i := 0; i < len(lines); {
+		if lines[i].kind == ' ' {
+			i++
+			continue
+		}
+		// Extend the hunk over changes separated by at most twice the context.
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(lines) && j-end <= 2*context; j++ {
+			if lines[j].kind != ' ' {
+				end = j + 1
+			}
+		}
+		stop := end + context
+		if stop > len(lines) {
+			stop = len(lines)
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n",
+			hunkRange(aLine[start], aLine[stop]-aLine[start]),
+			hunkRange(bLine[start], bLine[stop]-bLine[start]))
+		for _, l := range lines[start:stop] {
+			sb.WriteByte(l.kind)
+			sb.WriteString(l.text)
+			sb.WriteByte('\n')
+		}
+		i = stop
+	}
+	return sb.String()
+}
+
+// hunkRange formats the start and length of a hunk like diff -u does, where
+// an empty range refers to the line before it.
+func hunkRange(start, n int) string {
+	switch n {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
@@ -0,0 +1,67 @@
+package postdock
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ErrRoleInUse is returned by DropCascade when the owner of the database
+// still owns objects in other databases, which must be dropped or reassigned
+// there first.
+var ErrRoleInUse = errors.New("role still owns objects in other databases")
+
+// DropCascade drops dbName like Drop and then its owner role, after
+// reassigning or dropping whatever else the role owns. The role is kept if it
+// is opt.DBUser or opt.AdminUser. It is a no-op if dbName does not exist.
+//
+// REASSIGN OWNED and DROP OWNED only affect the database they run in, so the
+// role can only be dropped if it does not own objects in other databases,
+// otherwise ErrRoleInUse is returned after dbName was dropped.
+func DropCascade(dbName string, opt Options) (err error) {
+	defer trace("DropCascade", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return err
+	}
+
+	q := fmt.Sprintf("SELECT coalesce((SELECT pg_get_userbyid(datdba) FROM pg_database WHERE datname = %s), '')", quoteLiteral(dbName))
+	owner, err := queryScalar("postgres", q, opt.admin())
+	if err != nil {
+		return err
+	}
+	if owner == "" && !opt.DryRun {
+		if opt.Debug {
+			log.Printf("skipping drop of missing db:%s", dbName)
+		}
+		return nil
+	}
+
+	if err := Drop(dbName, opt); err != nil {
+		return err
+	}
+	// The roles are created with unquoted names, which postgres folds to
+	// lower case, e.g. DBUser App is the role app.
+	if strings.EqualFold(owner, opt.DBUser) || strings.EqualFold(owner, opt.AdminUser) {
+		return nil
+	}
+
+	role := quoteName(owner)
+	queries := []string{
+		"REASSIGN OWNED BY " + role + " TO CURRENT_USER",
+		"DROP OWNED BY " + role,
+		"DROP ROLE " + role,
+	}
+	if _, err := execQuery("postgres", strings.Join(queries, "; "), opt.admin()); err != nil {
+		if strings.Contains(err.Error(), "cannot be dropped because some objects depend on it") {
+			return fmt.Errorf("%s: %w: %v", owner, ErrRoleInUse, err)
+		}
+		return err
+	}
+	if opt.Debug {
+		log.Printf("successfully dropped owner role:%s of db:%s", owner, dbName)
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package postdock
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDropCascadeRole(t *testing.T) {
+	tests := []struct {
+		name, owner, user string
+		dropRole          string
+	}{
+		{"owner role", "owner", "app", `DROP ROLE "owner"`},
+		{"dotted role", "app.user", "app", `DROP ROLE "app.user"`},
+		{"user role", "app", "app", ""},
+		{"folded user role", "app", "App", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := &recordingHook{}
+			opt := testOptions()
+			opt.DBUser = tt.user
+			opt.Hook = hook
+			opt.PsqlPath = fakeScript(t, "psql", `case "$*" in
+*pg_get_userbyid*) printf 'coalesce\n%s\n(1 row)\n' `+quote(tt.owner)+` ;;
+*"FROM pg_database"*) printf 'exists\nt\n(1 row)\n' ;;
+*pg_terminate_backend*) printf 'count\n0\n(1 row)\n' ;;
+esac`)
+			if err := DropCascade("appdb", opt); err != nil {
+				t.Fatal(err)
+			}
+			var dropped string
+			for _, e := range hook.commands {
+				if strings.Contains(e.Command, "DROP ROLE") {
+					dropped = e.Command
+				}
+			}
+			switch {
+			case tt.dropRole == "" && dropped != "":
+				t.Errorf("dropped the role of DBUser: %s", dropped)
+			case tt.dropRole != "" && !strings.Contains(dropped, tt.dropRole):
+				t.Errorf("got %q, want it to contain %s", dropped, tt.dropRole)
+			}
+		})
+	}
+}
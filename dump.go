@@ -0,0 +1,377 @@
+package postdock
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DumpFormat is the archive format written by Dump, see pg_dump --format.
+type DumpFormat string
+
+const (
+	// FormatPlain is a plain sql script, the default. It is applied with
+	// Import rather than Restore.
+	FormatPlain DumpFormat = "plain"
+	// FormatCustom is a compressed archive for Restore.
+	FormatCustom DumpFormat = "custom"
+	// FormatDirectory is a directory with one file per table, the only format
+	// supporting parallel dumps.
+	FormatDirectory DumpFormat = "directory"
+	// FormatTar is a tar archive for Restore.
+	FormatTar DumpFormat = "tar"
+)
+
+// DumpOptions configures Dump.
+type DumpOptions struct {
+	// Format defaults to FormatPlain, or to FormatDirectory when Jobs > 1.
+	Format DumpFormat
+	// Jobs is the number of tables dumped in parallel, defaults to 1. More
+	// than 1 requires FormatDirectory.
+	Jobs int
+	// LargeObjects controls whether large objects are dumped, defaults to
+	// pg_dump's behavior of including them unless the dump is limited to
+	// some schemas or tables.
+	LargeObjects LargeObjects
+	// ExtraArgs are passed to pg_dump after the flags set by Dump, e.g.
+	// --section=pre-data or --load-via-partition-root. Each must be a single
+	// flag starting with -, it is passed verbatim apart from shell quoting.
+	ExtraArgs []string
+}
+
+// LargeObjects controls large objects in Dump, see pg_dump --large-objects.
+type LargeObjects int
+
+const (
+	// LargeObjectsDefault leaves the choice to pg_dump.
+	LargeObjectsDefault LargeObjects = iota
+	// LargeObjectsInclude always dumps large objects.
+	LargeObjectsInclude
+	// LargeObjectsExclude never dumps large objects, requires pg_dump 10 or
+	// later.
+	LargeObjectsExclude
+)
+
+// largeObjectsFlag returns the pg_dump flag for lo, if any. pg_dump 16 renamed
+// --blobs and --no-blobs to --large-objects and --no-large-objects, and while
+// it still accepts the old names they are deprecated.
+func largeObjectsFlag(lo LargeObjects, opt Options) (string, error) {
+	if lo == LargeObjectsDefault {
+		return "", nil
+	}
+	version, err := ClientVersion(opt)
+	if err != nil {
+		return "", err
+	}
+	// Without a version in a dry run, the old names work with any pg_dump.
+	newNames := version >= 160000
+	switch lo {
+	case LargeObjectsInclude:
+		if newNames {
+			return "--large-objects", nil
+		}
+		return "--blobs", nil
+	case LargeObjectsExclude:
+		if newNames {
+			return "--no-large-objects", nil
+		}
+		if version != 0 && version < 100000 {
+			return "", fmt.Errorf("postdock: excluding large objects requires pg_dump 10 or later, got %d", version)
+		}
+		return "--no-blobs", nil
+	}
+	return "", fmt.Errorf("postdock: invalid large objects option: %d", lo)
+}
+
+// RestoreOptions configures Restore.
+type RestoreOptions struct {
+	// Jobs is the number of parallel restore workers, defaults to 1. Only
+	// custom and directory archives can be restored in parallel.
+	Jobs int
+	// ExtraArgs are passed to pg_restore like DumpOptions.ExtraArgs, e.g.
+	// --disable-triggers.
+	ExtraArgs []string
+	// Filter, if set, selects the entries of the archive to restore, see
+	// ListArchive, e.g. to restore everything but the data of a large table.
+	// Entries depending on a skipped one, such as the indexes of a skipped
+	// table, fail to restore unless skipped as well.
+	Filter func(ArchiveEntry) bool
+}
+
+// ArchiveEntry is an entry of the table of contents of an archive written by
+// Dump, as listed by pg_restore --list.
+type ArchiveEntry struct {
+	// ID is the dump id of the entry.
+	ID int
+	// Type is the kind of object, e.g. TABLE, TABLE DATA, INDEX or
+	// FK CONSTRAINT.
+	Type string
+	// Schema is empty for objects outside a schema, e.g. a SCHEMA itself.
+	Schema string
+	// Name of the object, e.g. the table name. Some entries name the object
+	// they belong to as well, e.g. "orders orders_pkey" for a constraint or
+	// "SCHEMA public" for a comment.
+	Name  string
+	Owner string
+
+	line string
+}
+
+// archiveEntryTypes are the types of ArchiveEntry of more than one word, so
+// the line of an entry can be split into its fields.
+var archiveEntryTypes = []string{
+	"DEFAULT ACL", "FK CONSTRAINT", "FOREIGN DATA WRAPPER", "FOREIGN TABLE",
+	"INDEX ATTACH", "LARGE OBJECT", "MATERIALIZED VIEW DATA", "MATERIALIZED VIEW",
+	"ROW SECURITY", "SEQUENCE OWNED BY", "SEQUENCE SET",
+	"TABLE ATTACH", "TABLE DATA", "TEXT SEARCH CONFIGURATION",
+	"TEXT SEARCH DICTIONARY", "TEXT SEARCH PARSER", "TEXT SEARCH TEMPLATE",
+	"USER MAPPING", "EVENT TRIGGER", "OPERATOR CLASS", "OPERATOR FAMILY",
+	"PUBLICATION TABLE", "PUBLICATION TABLES IN SCHEMA", "ACCESS METHOD",
+}
+
+// ListArchive returns the entries of a custom, directory or tar archive
+// written by Dump, in the order pg_restore restores them. Like Dump, archive
+// may be relative or absolute.
+func ListArchive(archive string, opt Options) (_ []ArchiveEntry, err error) {
+	defer trace("ListArchive", "", &opt)(&err)
+
+	if err := opt.isValid("postgres"); err != nil {
+		return nil, err
+	}
+	if archive == "" {
+		return nil, errors.New("postdock: required option: archive to list")
+	}
+
+	return listArchive(archive, opt)
+}
+
+func listArchive(archive string, opt Options) ([]ArchiveEntry, error) {
+	file, vol, err := mountFile(archive, opt)
+	if err != nil {
+		return nil, err
+	}
+	out, err := run(quote(opt.normalize().PgRestorePath)+" --list "+quote(file), opt, vol)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []ArchiveEntry
+	for _, line := range strings.Split(out, "\n") {
+		// Not trimmed, an empty owner leaves a trailing space.
+		line = strings.TrimSuffix(line, "\r")
+		// Comments start with a semicolon.
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		e, err := parseArchiveEntry(line)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// parseArchiveEntry parses a line of pg_restore --list, e.g.
+// "215; 1259 16386 TABLE public users postgres". The owner is empty for
+// some entries, e.g. "5; 3079 16385 EXTENSION - pgcrypto ", leaving a
+// trailing space.
+func parseArchiveEntry(line string) (ArchiveEntry, error) {
+	invalid := fmt.Errorf("postdock: unexpected archive entry: %q", line)
+	i := strings.Index(line, "; ")
+	if i < 0 {
+		return ArchiveEntry{}, invalid
+	}
+	id, err := strconv.Atoi(line[:i])
+	if err != nil {
+		return ArchiveEntry{}, invalid
+	}
+	// Skip the catalog table and object oids.
+	fields := strings.SplitN(line[i+2:], " ", 3)
+	if len(fields) != 3 {
+		return ArchiveEntry{}, invalid
+	}
+	rest := fields[2]
+	typ := rest[:strings.Index(rest+" ", " ")]
+	for _, t := range archiveEntryTypes {
+		if strings.HasPrefix(rest, t+" ") {
+			typ = t
+			break
+		}
+	}
+	rest = strings.TrimPrefix(rest, typ+" ")
+	j := strings.Index(rest, " ")
+	k := strings.LastIndex(rest, " ")
+	if j < 0 || k <= j {
+		return ArchiveEntry{}, invalid
+	}
+	e := ArchiveEntry{ID: id, Type: typ, Schema: rest[:j], Name: rest[j+1 : k], Owner: rest[k+1:], line: line}
+	if e.Schema == "-" {
+		e.Schema = ""
+	}
+	return e, nil
+}
+
+// extraArgs validates and quotes the ExtraArgs of DumpOptions,
+// RestoreOptions or Options.
+func extraArgs(args []string) ([]string, error) {
+	quoted := make([]string, 0, len(args))
+	for _, a := range args {
+		if !strings.HasPrefix(a, "-") {
+			return nil, fmt.Errorf("postdock: invalid extra argument %q: must be a flag starting with -", a)
+		}
+		quoted = append(quoted, quote(a))
+	}
+	return quoted, nil
+}
+
+// Dump runs pg_dump for dbName and writes the archive to output, a file or,
+// for FormatDirectory, a directory, which must not exist yet. output may be
+// relative to the current working directory or absolute, its parent
+// directory is created if missing and mounted into the container. Files
+// written by the container are owned by root unless RunAsCurrentUser is set.
+func Dump(dbName string, output string, dopt DumpOptions, opt Options) (err error) {
+	defer trace("Dump", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return err
+	}
+	if output == "" {
+		return errors.New("postdock: required option: output file")
+	}
+	if dopt.Jobs < 0 {
+		return fmt.Errorf("postdock: invalid number of jobs: %d", dopt.Jobs)
+	}
+	if dopt.Format == "" {
+		dopt.Format = FormatPlain
+		if dopt.Jobs > 1 {
+			dopt.Format = FormatDirectory
+		}
+	}
+	if dopt.Jobs > 1 && dopt.Format != FormatDirectory {
+		return fmt.Errorf("postdock: parallel dump requires the directory format, got %s", dopt.Format)
+	}
+
+	file, vol, err := mountFile(output, opt)
+	if err != nil {
+		return err
+	}
+	if !opt.DryRun {
+		// Otherwise docker creates it, owned by root.
+		if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+			return err
+		}
+	}
+
+	args := []string{"--format=" + string(dopt.Format), "--file=" + quote(file)}
+	if dopt.Jobs > 1 {
+		args = append(args, "--jobs="+strconv.Itoa(dopt.Jobs))
+	}
+	flag, err := largeObjectsFlag(dopt.LargeObjects, opt)
+	if err != nil {
+		return err
+	}
+	if flag != "" {
+		args = append(args, flag)
+	}
+	extra, err := extraArgs(dopt.ExtraArgs)
+	if err != nil {
+		return err
+	}
+	args = append(args, extra...)
+	if _, err := run(pgDumpCmd(dbName, opt, args...), opt.bounded(), vol); err != nil {
+		return versionMismatchError(err, opt)
+	}
+
+	if opt.Debug {
+		log.Printf("successfully dumped db:%s to %s (format:%s)", dbName, output, dopt.Format)
+	}
+
+	return nil
+}
+
+// Restore runs pg_restore to load a custom, directory or tar archive, as
+// written by Dump, into dbName. Like Import, dbName is dropped and created
+// first. Like Dump, archive may be relative or absolute. Plain sql dumps are
+// applied with Import instead. With RestoreOptions.Filter only the selected
+// entries are restored, by passing their list to pg_restore --use-list.
+func Restore(dbName string, archive string, ropt RestoreOptions, opt Options) (err error) {
+	defer trace("Restore", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return err
+	}
+	if archive == "" {
+		return errors.New("postdock: required option: archive to restore")
+	}
+	if ropt.Jobs < 0 {
+		return fmt.Errorf("postdock: invalid number of jobs: %d", ropt.Jobs)
+	}
+	// Checked before dropping, so an invalid argument leaves dbName alone.
+	extra, err := extraArgs(ropt.ExtraArgs)
+	if err != nil {
+		return err
+	}
+	file, vol, err := mountFile(archive, opt)
+	if err != nil {
+		return err
+	}
+	// Listed before dropping, so an unreadable archive leaves dbName alone.
+	var useList io.Reader
+	if ropt.Filter != nil {
+		entries, err := listArchive(archive, opt)
+		if err != nil {
+			return err
+		}
+		var list strings.Builder
+		for _, e := range entries {
+			if ropt.Filter(e) {
+				list.WriteString(e.line + "\n")
+			}
+		}
+		useList = strings.NewReader(list.String())
+	}
+
+	if err := Drop(dbName, opt); err != nil {
+		return err
+	}
+	if err := Create(dbName, opt); err != nil {
+		return err
+	}
+
+	var args []string
+	if ropt.Jobs > 1 {
+		args = append(args, "--jobs="+strconv.Itoa(ropt.Jobs))
+	}
+	args = append(args, extra...)
+	if useList != nil {
+		// Passed over stdin, so no file is mounted for it.
+		args = append(args, "--use-list=/dev/stdin")
+	}
+	args = append(args, quote(file))
+	if _, err := runInput(pgRestoreCmd(dbName, opt, args...), useList, opt.bounded(), vol); err != nil {
+		return err
+	}
+
+	if opt.Debug {
+		log.Printf("successfully restored db:%s from %s", dbName, archive)
+	}
+
+	return nil
+}
+
+// pgRestoreCmd builds a pg_restore command into the given database with the
+// connection flags from o. Like psqlCmd, args must already be quoted.
+func pgRestoreCmd(dbName string, o Options, args ...string) string {
+	o = o.normalize()
+	if !o.ContinueOnError {
+		args = append([]string{"--exit-on-error"}, args...)
+	}
+	return fmt.Sprintf("%s %s -h %s -p %d -U %s -d %s --no-owner %s",
+		pgEnv(o), quote(o.PgRestorePath), o.DBHost, o.DBPort, o.DBUser, dbName, strings.Join(args, " "))
+}
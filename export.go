@@ -0,0 +1,117 @@
+package postdock
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ExportOptions configures ExportAllCSV.
+type ExportOptions struct {
+	// Schemas limits the export to tables in these schemas, defaults to all
+	// but the system schemas.
+	Schemas []string
+	// Header writes the column names as the first line of each file.
+	Header bool
+}
+
+// ExportAllCSV writes every table of dbName to its own csv file in destDir,
+// named <table>.csv for tables in the public schema and <schema>.<table>.csv
+// otherwise, and returns the paths of the written files. Like Dump, destDir
+// may be relative to the current working directory or absolute; it is
+// created if missing. Each table is exported with psql's \copy, so the files
+// are written by the client rather than the server.
+func ExportAllCSV(dbName string, destDir string, eopt ExportOptions, opt Options) (_ []string, err error) {
+	defer trace("ExportAllCSV", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return nil, err
+	}
+	if destDir == "" {
+		return nil, errors.New("postdock: required option: export directory")
+	}
+	cmdDir, vol, err := mountDir(destDir, opt)
+	if err != nil {
+		return nil, err
+	}
+	opt = opt.reader()
+
+	where := "schemaname NOT IN ('pg_catalog', 'information_schema')"
+	if len(eopt.Schemas) > 0 {
+		var schemas []string
+		for _, s := range eopt.Schemas {
+			schemas = append(schemas, quoteLiteral(s))
+		}
+		where = fmt.Sprintf("schemaname IN (%s)", strings.Join(schemas, ", "))
+	}
+	q := fmt.Sprintf(`SELECT coalesce(string_agg(schemaname || E'\t' || tablename, E'\n' ORDER BY schemaname, tablename), '')
+FROM pg_catalog.pg_tables WHERE %s`, where)
+	out, err := queryScalar(dbName, q, opt)
+	if err != nil {
+		return nil, err
+	}
+	if opt.DryRun {
+		// Nothing is queried in dry-run mode, show the script for a
+		// placeholder table instead.
+		out = "<schema>\t<table>"
+	}
+	if out == "" {
+		return nil, nil
+	}
+
+	format := "csv"
+	if eopt.Header {
+		format = "csv, HEADER"
+	}
+	var files []string
+	var script strings.Builder
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("postdock: unexpected table list output: %q", line)
+		}
+		schema, table := parts[0], parts[1]
+		name := table + ".csv"
+		if schema != "public" {
+			name = schema + "." + name
+		}
+		if strings.ContainsAny(name, "/\n") {
+			return nil, fmt.Errorf("postdock: cannot export table %s.%s: invalid file name", schema, table)
+		}
+		files = append(files, filepath.Join(destDir, name))
+		file := path.Join(cmdDir, name)
+		if opt.local() {
+			file = filepath.Join(cmdDir, name)
+		}
+		// \copy takes the rest of the line as its arguments. Names may
+		// contain dots, so each is quoted as a single identifier.
+		fmt.Fprintf(&script, "\\copy %s.%s TO %s WITH (FORMAT %s)\n",
+			quoteName(schema), quoteName(table), quoteLiteral(file), format)
+	}
+
+	if !opt.DryRun {
+		if err := os.MkdirAll(destDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	cmd := psqlCmd(dbName, opt, "--file=-")
+	if opt.DryRun {
+		log.Printf("dry run: script of %s:\n%s", cmd, redact(script.String(), opt))
+	}
+	if _, err := runInput(cmd, strings.NewReader(script.String()), opt.bounded(), vol); err != nil {
+		return nil, err
+	}
+	if opt.DryRun {
+		return nil, nil
+	}
+
+	if opt.Debug {
+		log.Printf("successfully exported %d tables of db:%s to %s", len(files), dbName, destDir)
+	}
+
+	return files, nil
+}
@@ -0,0 +1,22 @@
+package postdock
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExportAllCSVDryRun(t *testing.T) {
+	dir := t.TempDir()
+	out := dryRun(t, func(opt Options) error {
+		_, err := ExportAllCSV("app", dir, ExportOptions{Header: true}, opt)
+		return err
+	}, testOptions())
+
+	want := `\copy "<schema>"."<table>" TO '` + dir + `/<schema>.<table>.csv' WITH (FORMAT csv, HEADER)`
+	if !strings.Contains(out, want) {
+		t.Errorf("dry run lacks the script %s:\n%s", want, out)
+	}
+	if !strings.Contains(out, "--file=-") {
+		t.Errorf("dry run lacks the psql command:\n%s", out)
+	}
+}
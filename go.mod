@@ -1,5 +1,5 @@
 module github.com/mfridman/postdock
 
-go 1.14
+go 1.16
 
 require github.com/bitfield/script v0.18.0
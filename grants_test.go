@@ -0,0 +1,113 @@
+package postdock
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCreateGrantsWithAdmin(t *testing.T) {
+	opt := testOptions()
+	opt.DBUser = "app"
+	opt.DBPassword = "app-secret"
+	opt.AdminUser = "postgres"
+	opt.AdminPassword = "admin-secret"
+	out := dryRun(t, func(opt Options) error { return Create("appdb", opt) }, opt)
+
+	var grants []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.Contains(line, "GRANT") {
+			grants = append(grants, line)
+		}
+	}
+	if len(grants) != 1 {
+		t.Fatalf("got %d grant commands, want 1:\n%s", len(grants), out)
+	}
+	if !strings.Contains(grants[0], "-U postgres") {
+		t.Errorf("grants do not run as the admin role: %s", grants[0])
+	}
+	for _, want := range []string{
+		"ALTER DEFAULT PRIVILEGES FOR ROLE app IN SCHEMA \"public\" GRANT ALL PRIVILEGES ON TABLES TO app",
+		"ALTER DEFAULT PRIVILEGES FOR ROLE app IN SCHEMA \"public\" GRANT ALL PRIVILEGES ON SEQUENCES TO app",
+	} {
+		if !strings.Contains(grants[0], want) {
+			t.Errorf("grants lack %q: %s", want, grants[0])
+		}
+	}
+	if strings.Contains(grants[0], "ALTER DEFAULT PRIVILEGES IN SCHEMA") {
+		t.Errorf("default privileges without FOR ROLE only cover the admin role: %s", grants[0])
+	}
+}
+
+func TestGrantCreators(t *testing.T) {
+	tests := []struct {
+		user, owner, want string
+	}{
+		{"app", "", "app"},
+		{"app", "app", "app"},
+		{"app", "App", "App"},
+		{"app", "owner", "owner, app"},
+	}
+	for _, tt := range tests {
+		opt := Options{DBUser: tt.user, DBOwner: tt.owner, AdminUser: "postgres"}
+		if got := grantCreators(opt); got != tt.want {
+			t.Errorf("grantCreators(user %s, owner %s) = %q, want %q", tt.user, tt.owner, got, tt.want)
+		}
+	}
+}
+
+func TestCreateSkipGrants(t *testing.T) {
+	opt := testOptions()
+	opt.Schemas = []string{"app"}
+	opt.SkipGrants = true
+	out := dryRun(t, func(opt Options) error { return Create("appdb", opt) }, opt)
+	if !strings.Contains(out, "CREATE DATABASE appdb") {
+		t.Fatalf("database not created:\n%s", out)
+	}
+	if strings.Contains(out, "GRANT") {
+		t.Errorf("grants applied despite SkipGrants:\n%s", out)
+	}
+}
+
+func TestGrantQueries(t *testing.T) {
+	const (
+		tables     = `GRANT ALL PRIVILEGES ON ALL TABLES IN SCHEMA "%s" TO app`
+		sequences  = `GRANT ALL PRIVILEGES ON ALL SEQUENCES IN SCHEMA "%s" TO app`
+		defTables  = `ALTER DEFAULT PRIVILEGES FOR ROLE app IN SCHEMA "%s" GRANT ALL PRIVILEGES ON TABLES TO app`
+		defSeqs    = `ALTER DEFAULT PRIVILEGES FOR ROLE app IN SCHEMA "%s" GRANT ALL PRIVILEGES ON SEQUENCES TO app`
+		schemaPriv = `GRANT ALL ON SCHEMA "%s" TO app`
+	)
+	grants := func(schema string, withSchema bool) []string {
+		var q []string
+		if withSchema {
+			q = append(q, fmt.Sprintf(schemaPriv, schema))
+		}
+		for _, f := range []string{tables, sequences, defTables, defSeqs} {
+			q = append(q, fmt.Sprintf(f, schema))
+		}
+		return q
+	}
+	tests := []struct {
+		name    string
+		schemas []string
+		version int
+		want    []string
+	}{
+		{"pg14 default", nil, 140010, grants("public", false)},
+		{"pg15 default", nil, 150002, grants("public", true)},
+		{"pg16 public", []string{"public"}, 160000, grants("public", true)},
+		{"pg14 schemas", []string{"public", "app"}, 140010, append(grants("public", false), grants("app", true)...)},
+		{"pg15 schemas", []string{"public", "app"}, 150000, append(grants("public", true), grants("app", true)...)},
+		{"unknown version", nil, 0, grants("public", false)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := grantQueries(tt.schemas, "app", "app", tt.version)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("grantQueries(%v, %d) =\n%s\nwant\n%s", tt.schemas, tt.version,
+					strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package postdock
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"testing"
+)
+
+// testOptions returns Options which run the client tools directly, without
+// docker.
+func testOptions() Options {
+	return Options{
+		DockerImage: "postgres:16-alpine",
+		DBHost:      "localhost",
+		DBUser:      "postgres",
+		DBPassword:  "secret",
+		ForceLocal:  true,
+	}
+}
+
+// fakeTool writes a shell script named name which prints output, and returns
+// its path.
+func fakeTool(t *testing.T, name, output string) string {
+	t.Helper()
+	return fakeScript(t, name, "cat <<'EOF'\n"+output+"\nEOF")
+}
+
+// fakeScript writes a shell script named name running body, e.g. a case
+// statement on "$*" printing the output for each query, and returns its path.
+func fakeScript(t *testing.T, name, body string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(p, []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// dryRun returns the commands logged by f in DryRun mode.
+func dryRun(t *testing.T, f func(opt Options) error, opt Options) string {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	flags := log.Flags()
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(ioutil.Discard)
+		log.SetFlags(flags)
+	}()
+	opt.DryRun = true
+	if err := f(opt); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
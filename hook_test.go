@@ -0,0 +1,112 @@
+package postdock
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingHook struct {
+	mu       sync.Mutex
+	events   []string
+	commands []CommandEvent
+}
+
+func (h *recordingHook) OnStart(op, dbName string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, "start "+op+" "+dbName)
+}
+
+func (h *recordingHook) OnFinish(op, dbName string, dur time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, "finish "+op+" "+dbName)
+}
+
+func (h *recordingHook) OnCommand(e CommandEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.commands = append(h.commands, e)
+}
+
+func TestCommandHook(t *testing.T) {
+	hook := &recordingHook{}
+	opt := testOptions()
+	opt.DBPassword = "hunter2"
+	opt.PsqlPath = fakeTool(t, "psql", "v\n42\n(1 row)")
+	opt.Hook = hook
+	got, err := QueryScalar("app", "select 42", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "42" {
+		t.Errorf("QueryScalar = %q, want 42", got)
+	}
+	want := []string{"start QueryScalar app", "finish QueryScalar app"}
+	if strings.Join(hook.events, ",") != strings.Join(want, ",") {
+		t.Errorf("events = %q, want %q", hook.events, want)
+	}
+	if len(hook.commands) != 1 {
+		t.Fatalf("got %d command events, want 1", len(hook.commands))
+	}
+	e := hook.commands[0]
+	if e.Op != "QueryScalar" || e.DBName != "app" || e.Name != "psql" || e.Err != nil {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if strings.Contains(e.Command, "hunter2") || !strings.Contains(e.Command, "select 42") {
+		t.Errorf("command not redacted or incomplete: %s", e.Command)
+	}
+}
+
+func TestCommandName(t *testing.T) {
+	tests := []struct {
+		cmd, want string
+	}{
+		{"psql -h db", "psql"},
+		{"PGPASSWORD='********' PGOPTIONS='-c search_path=app' /usr/bin/psql -h db", "psql"},
+		{"PGPASSFILE='/tmp/a b/pgpass' pg_dump db", "pg_dump"},
+		{"'/opt/my tools/pg_restore' -d db", "pg_restore"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := commandName(tt.cmd); got != tt.want {
+			t.Errorf("commandName(%q) = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestCountRowsOps(t *testing.T) {
+	hook := &recordingHook{}
+	opt := testOptions()
+	opt.PsqlPath = fakeTool(t, "psql", "count\n3\n(1 row)")
+	opt.Hook = hook
+	if _, err := CountRows("app", "t", opt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CountRowsWhere("app", "t", "id > 1", opt); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"start CountRows app", "finish CountRows app", "start CountRowsWhere app", "finish CountRowsWhere app"}
+	if strings.Join(hook.events, ",") != strings.Join(want, ",") {
+		t.Errorf("events = %q, want %q", hook.events, want)
+	}
+}
+
+func TestWaitForExtensionOp(t *testing.T) {
+	hook := &recordingHook{}
+	opt := testOptions()
+	opt.PsqlPath = fakeTool(t, "psql", "t")
+	opt.Hook = hook
+	if err := WaitForExtension("app", "postgis", WaitOptions{}, opt); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"start WaitForExtension app", "finish WaitForExtension app"}
+	if strings.Join(hook.events, ",") != strings.Join(want, ",") {
+		t.Errorf("events = %q, want %q", hook.events, want)
+	}
+	if len(hook.commands) != 1 || hook.commands[0].Op != "WaitForExtension" {
+		t.Errorf("commands = %+v, want one of WaitForExtension", hook.commands)
+	}
+}
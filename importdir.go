@@ -0,0 +1,200 @@
+package postdock
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TransactionScope controls how ImportDir wraps sql files in transactions.
+type TransactionScope int
+
+const (
+	// TransactionNone applies each file as is, statements outside an explicit
+	// transaction are committed as they run.
+	TransactionNone TransactionScope = iota
+	// TransactionPerFile applies each file in its own transaction. A failing
+	// file is rolled back, files applied before it stay committed.
+	TransactionPerFile
+	// TransactionWholeBatch applies all files in a single transaction, so
+	// either all or none of them are committed.
+	TransactionWholeBatch
+)
+
+// ImportError is returned when psql fails to apply a statement from a sql
+// file. It unwraps to the raw psql error.
+type ImportError struct {
+	File    string
+	Line    int
+	Message string
+
+	err error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.err
+}
+
+// ImportDirError is returned by ImportDir with Options.ImportJobs greater than
+// 1 when one or more files failed. Errors has an error per failed file, in
+// lexical order, usually an *ImportError. It unwraps to the first of them.
+type ImportDirError struct {
+	Errors []error
+}
+
+func (e *ImportDirError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d files failed to import: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+func (e *ImportDirError) Unwrap() error {
+	return e.Errors[0]
+}
+
+// psqlFileError matches the error psql reports for a statement from a
+// file, e.g. "psql:data/schema.sql:12: ERROR:  relation "x" does not exist".
+var psqlFileError = regexp.MustCompile(`psql:(.+?):(\d+): ERROR:\s+(.*)`)
+
+// parseImportError returns an *ImportError if err contains a psql file
+// error, otherwise err as is.
+func parseImportError(err error) error {
+	m := psqlFileError.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+	line, _ := strconv.Atoi(m[2])
+	return &ImportError{File: m[1], Line: line, Message: m[3], err: err}
+}
+
+// ImportDir applies every .sql file in dir to the existing database dbName,
+// in lexical order, e.g. 001_users.sql before 002_orders.sql. Unlike Import,
+// the database is not dropped and recreated first. Like Dump, dir may be
+// relative or absolute.
+//
+// How the files are wrapped in transactions is controlled by
+// Options.TransactionScope. A failing statement is reported as an
+// *ImportError naming the file and line.
+//
+// With Options.ImportJobs greater than 1, that many files are applied at a
+// time, for files which do not depend on each other. A failing file does not
+// stop the others, the failures are reported together as an *ImportDirError.
+func ImportDir(dbName string, dir string, opt Options) (err error) {
+	defer trace("ImportDir", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return err
+	}
+	if dir == "" {
+		return errors.New("postdock: required option: directory to import")
+	}
+	if opt.ImportJobs < 0 {
+		return fmt.Errorf("postdock: invalid number of import jobs: %d", opt.ImportJobs)
+	}
+	if opt.ImportJobs > 1 && opt.TransactionScope == TransactionWholeBatch {
+		return errors.New("postdock: import jobs cannot be combined with a single transaction for the whole batch")
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("postdock: no .sql files in directory: %s", dir)
+	}
+	cmdDir, vol, err := mountDir(dir, opt)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case opt.TransactionScope == TransactionWholeBatch:
+		args := []string{"--single-transaction"}
+		for _, f := range files {
+			args = append(args, "--file="+quote(path.Join(cmdDir, filepath.Base(f))))
+		}
+		if _, err := run(psqlCmd(dbName, opt, args...), opt.bounded(), vol); err != nil {
+			return hostImportError(parseImportError(err), cmdDir, dir)
+		}
+	case opt.ImportJobs > 1:
+		if err := importFilesParallel(dbName, files, cmdDir, vol, opt); err != nil {
+			return err
+		}
+	default:
+		for _, f := range files {
+			if err := importDirFile(dbName, f, cmdDir, vol, opt); err != nil {
+				return err
+			}
+		}
+	}
+
+	if opt.Debug {
+		log.Printf("successfully imported %d files into db:%s from dir:%s", len(files), dbName, dir)
+	}
+
+	return nil
+}
+
+// importDirFile applies a single file of ImportDir, which commands find in
+// cmdDir, see mountDir.
+func importDirFile(dbName string, file string, cmdDir string, vol string, opt Options) error {
+	var args []string
+	if opt.TransactionScope == TransactionPerFile {
+		args = append(args, "--single-transaction")
+	}
+	args = append(args, "--file="+quote(path.Join(cmdDir, filepath.Base(file))))
+	if _, err := run(psqlCmd(dbName, opt, args...), opt.bounded(), vol); err != nil {
+		return hostImportError(parseImportError(err), cmdDir, filepath.Dir(file))
+	}
+	return nil
+}
+
+// hostImportError replaces the directory cmdDir, where commands found the
+// file of an *ImportError, with dir on the host.
+func hostImportError(err error, cmdDir string, dir string) error {
+	var ierr *ImportError
+	if errors.As(err, &ierr) && path.Dir(ierr.File) == cmdDir {
+		ierr.File = filepath.Join(dir, path.Base(ierr.File))
+	}
+	return err
+}
+
+// importFilesParallel applies files with up to opt.ImportJobs at a time and
+// returns an *ImportDirError if any failed.
+func importFilesParallel(dbName string, files []string, cmdDir string, vol string, opt Options) error {
+	errs := make([]error, len(files))
+	sem := make(chan struct{}, opt.ImportJobs)
+	var wg sync.WaitGroup
+	for i, f := range files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, f string) {
+			defer func() { <-sem; wg.Done() }()
+			errs[i] = importDirFile(dbName, f, cmdDir, vol, opt)
+		}(i, f)
+	}
+	wg.Wait()
+
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) > 0 {
+		return &ImportDirError{Errors: failed}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package postdock
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"strings"
+)
+
+// ImportFS is like Import but reads the sql from fsys, e.g. an embed.FS, so no
+// file on the host is needed. If name is a directory, every .sql file in it is
+// applied in lexical order. The contents are piped to psql's stdin instead of
+// being mounted into the container.
+func ImportFS(dbName string, fsys fs.FS, name string, opt Options) (err error) {
+	defer trace("ImportFS", dbName, &opt)(&err)
+
+	if fsys == nil || name == "" {
+		return errors.New("postdock: required option: file system and sql file to import")
+	}
+	fi, err := fs.Stat(fsys, name)
+	if err != nil {
+		return err
+	}
+	files := []string{name}
+	if fi.IsDir() {
+		// Glob returns the matches in lexical order.
+		files, err = fs.Glob(fsys, path.Join(escapeGlob(name), "*.sql"))
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("postdock: no .sql files in directory: %s", name)
+		}
+	}
+
+	if err := Drop(dbName, opt); err != nil {
+		return err
+	}
+	if err := Create(dbName, opt); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		f, err := fsys.Open(file)
+		if err != nil {
+			return err
+		}
+		_, err = applyInput(dbName, f, opt)
+		f.Close()
+		if err != nil {
+			// psql only knows it read from stdin.
+			var ierr *ImportError
+			if errors.As(err, &ierr) {
+				ierr.File = file
+			}
+			return err
+		}
+	}
+
+	if opt.Debug {
+		log.Printf("successfully imported %d files into db:%s from %s", len(files), dbName, name)
+	}
+
+	return nil
+}
+
+// escapeGlob escapes the glob meta characters in name.
+func escapeGlob(name string) string {
+	r := strings.NewReplacer(`*`, `\*`, `?`, `\?`, `[`, `\[`, `\`, `\\`)
+	return r.Replace(name)
+}
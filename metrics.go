@@ -0,0 +1,102 @@
+package postdock
+
+import (
+	"sync"
+	"time"
+)
+
+// Metrics accumulates how long operations took, telling apart the time spent
+// pulling DockerImage from running commands, e.g. to find out that most of
+// the time of Create is spent pulling and PullIfNotPresent would help. Set it
+// on Options.Metrics; it is safe for concurrent use and may be shared by
+// several Options.
+type Metrics struct {
+	mu sync.Mutex
+
+	pull      time.Duration
+	pulls     int
+	command   time.Duration
+	commands  int
+	ops       map[string]time.Duration
+	opsCounts map[string]int
+}
+
+// MetricsSnapshot is a copy of the durations recorded by Metrics.
+type MetricsSnapshot struct {
+	// Pull is the time spent checking for and pulling the image, over Pulls
+	// attempts.
+	Pull  time.Duration
+	Pulls int
+	// Command is the time spent running psql, pg_dump and the like, including
+	// container startup, over Commands commands.
+	Command  time.Duration
+	Commands int
+	// Ops is the total time per exported operation, e.g. "Create", and
+	// OpsCounts how often it ran. Nested operations count towards both, e.g.
+	// the Create within Import.
+	Ops       map[string]time.Duration
+	OpsCounts map[string]int
+}
+
+// Snapshot returns the durations recorded so far.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := MetricsSnapshot{
+		Pull:      m.pull,
+		Pulls:     m.pulls,
+		Command:   m.command,
+		Commands:  m.commands,
+		Ops:       make(map[string]time.Duration, len(m.ops)),
+		OpsCounts: make(map[string]int, len(m.opsCounts)),
+	}
+	for op, d := range m.ops {
+		s.Ops[op] = d
+	}
+	for op, n := range m.opsCounts {
+		s.OpsCounts[op] = n
+	}
+	return s
+}
+
+// Reset clears the recorded durations.
+func (m *Metrics) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pull, m.pulls, m.command, m.commands = 0, 0, 0, 0
+	m.ops, m.opsCounts = nil, nil
+}
+
+func (m *Metrics) addPull(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pull += d
+	m.pulls++
+}
+
+func (m *Metrics) addCommand(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.command += d
+	m.commands++
+}
+
+func (m *Metrics) addOp(op string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ops == nil {
+		m.ops = make(map[string]time.Duration)
+		m.opsCounts = make(map[string]int)
+	}
+	m.ops[op] += d
+	m.opsCounts[op]++
+}
@@ -0,0 +1,108 @@
+package postdock
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// migrationsTable records the files applied by MigrateUp.
+const migrationsTable = "schema_migrations"
+
+// MigrateUp is a minimal migration runner: it applies the .sql files in dir
+// to the existing database dbName, in lexical order like ImportDir, skipping
+// those already recorded in the schema_migrations table, which is created if
+// missing. Each file is applied in its own transaction together with recording
+// it, so files must not contain transaction control or statements like CREATE
+// INDEX CONCURRENTLY. Files are recorded by base name. Like Dump, dir may be
+// relative or absolute.
+//
+// It returns the names of the files applied, up to but not including a
+// failing one, which is reported as an *ImportError.
+func MigrateUp(dbName string, dir string, opt Options) (_ []string, err error) {
+	defer trace("MigrateUp", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return nil, errors.New("postdock: required option: migrations directory")
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+	q := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version text PRIMARY KEY, applied_at timestamptz NOT NULL DEFAULT now());", migrationsTable)
+	if _, err := execQuery(dbName, q, opt); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(dbName, opt)
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[string]bool, len(applied))
+	for _, v := range applied {
+		done[v] = true
+	}
+	cmdDir, vol, err := mountDir(dir, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range files {
+		name := filepath.Base(f)
+		if done[name] {
+			continue
+		}
+		record := fmt.Sprintf("INSERT INTO %s (version) VALUES (%s);", migrationsTable, quoteLiteral(name))
+		cmd := psqlCmd(dbName, opt, "--single-transaction", "--file="+quote(path.Join(cmdDir, name)), "--command="+quote(record))
+		if _, err := run(cmd, opt.bounded(), vol); err != nil {
+			return names, hostImportError(parseImportError(err), cmdDir, dir)
+		}
+		names = append(names, name)
+		if opt.Debug {
+			log.Printf("applied migration %s to db:%s", name, dbName)
+		}
+	}
+
+	if opt.Debug {
+		log.Printf("successfully applied %d migrations to db:%s from dir:%s", len(names), dbName, dir)
+	}
+
+	return names, nil
+}
+
+// AppliedMigrations returns the names of the files applied by MigrateUp, in
+// order. It returns none if MigrateUp never ran.
+func AppliedMigrations(dbName string, opt Options) (_ []string, err error) {
+	defer trace("AppliedMigrations", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return nil, err
+	}
+
+	q := fmt.Sprintf("SELECT to_regclass(%s) IS NOT NULL;", quoteLiteral(migrationsTable))
+	out, err := queryScalar(dbName, q, opt.reader())
+	if err != nil {
+		return nil, err
+	}
+	exists, err := parseBool(out, opt)
+	if err != nil || !exists {
+		return nil, err
+	}
+	return appliedMigrations(dbName, opt)
+}
+
+func appliedMigrations(dbName string, opt Options) ([]string, error) {
+	q := fmt.Sprintf("SELECT coalesce(string_agg(version, E'\\n' ORDER BY version), '') FROM %s;", migrationsTable)
+	out, err := queryScalar(dbName, q, opt.reader())
+	if err != nil || out == "" {
+		return nil, err
+	}
+	return strings.Split(out, "\n"), nil
+}
@@ -0,0 +1,112 @@
+package postdock
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestOptionsReuse runs Import and SchemaDump with the same Options and
+// checks that neither changes what the other, or a second Import, sees.
+func TestOptionsReuse(t *testing.T) {
+	dir := t.TempDir()
+	hook := &recordingHook{}
+	opt := testOptions()
+	opt.PsqlPath = fakeServerPsql(t, dir)
+	opt.PgDumpPath = fakeTool(t, "pg_dump", "CREATE TABLE t (id int);")
+	opt.Variables = map[string]string{"tenant": "a"}
+	opt.Schemas = []string{"app"}
+	opt.Hook = hook
+	before := opt.Clone()
+	// Exists before both imports, so both drop it first.
+	if err := ioutil.WriteFile(filepath.Join(dir, "app"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Import("app", "testdata/import.sql", opt); err != nil {
+		t.Fatal(err)
+	}
+	first := append([]CommandEvent(nil), hook.commands...)
+	dump, err := SchemaDump("app", filepath.Join(dir, "schema.sql"), opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dump, "CREATE TABLE t") {
+		t.Errorf("unexpected dump %q", dump)
+	}
+	if n := len(hook.commands) - len(first); n != 1 || hook.commands[len(first)].Name != "pg_dump" {
+		t.Fatalf("SchemaDump ran %d commands, want pg_dump only", n)
+	}
+	if err := Import("app", "testdata/import.sql", opt); err != nil {
+		t.Fatal(err)
+	}
+	second := hook.commands[len(first)+1:]
+
+	if !reflect.DeepEqual(opt, before) {
+		t.Errorf("Options changed by the operations:\n%+v\nwant\n%+v", opt, before)
+	}
+	if len(first) != len(second) {
+		t.Fatalf("second Import ran %d commands, want %d", len(second), len(first))
+	}
+	for i := range first {
+		if first[i].Command != second[i].Command {
+			t.Errorf("second Import ran a different command:\n%s\nwant\n%s", second[i].Command, first[i].Command)
+		}
+	}
+}
+
+// TestCloneDeepCopies checks that Clone copies every slice, map and pointer
+// field of Options, except for Metrics which is meant to be shared.
+func TestCloneDeepCopies(t *testing.T) {
+	var o Options
+	v := reflect.ValueOf(&o).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if !f.CanSet() {
+			continue
+		}
+		switch f.Kind() {
+		case reflect.Slice:
+			f.Set(reflect.MakeSlice(f.Type(), 1, 1))
+		case reflect.Map:
+			m := reflect.MakeMap(f.Type())
+			m.SetMapIndex(reflect.ValueOf("k"), reflect.ValueOf("v"))
+			f.Set(m)
+		case reflect.Ptr:
+			f.Set(reflect.New(f.Type().Elem()))
+		}
+	}
+	o.secrets = []string{"s"}
+	o.passFileEntries = []string{"e"}
+
+	c := reflect.ValueOf(o.Clone())
+	typ := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		f, cf := v.Field(i), c.Field(i)
+		switch f.Kind() {
+		case reflect.Slice, reflect.Map, reflect.Ptr:
+		default:
+			continue
+		}
+		name := typ.Field(i).Name
+		if f.IsNil() {
+			t.Errorf("%s not set by the test", name)
+			continue
+		}
+		shared := f.Pointer() == cf.Pointer()
+		if name == "Metrics" {
+			if !shared {
+				t.Errorf("Clone copied Metrics, which is meant to be shared")
+			}
+			continue
+		}
+		if shared {
+			t.Errorf("Clone shares %s with the original", name)
+		}
+		if f.Kind() != reflect.Ptr && f.Len() != cf.Len() {
+			t.Errorf("Clone has %d elements of %s, want %d", cf.Len(), name, f.Len())
+		}
+	}
+}
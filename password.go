@@ -0,0 +1,43 @@
+package postdock
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+// ResolvePassword returns o with DBPassword read from PasswordFile or the
+// output of PasswordCommand, which runs with sh -c. It is a no-op if neither
+// is set. Resolve once and reuse the returned Options, rather than reading the
+// secret again for every operation.
+func (o Options) ResolvePassword() (Options, error) {
+	switch {
+	case o.PasswordFile != "" && o.PasswordCommand != "":
+		return o, errors.New("postdock: PasswordFile and PasswordCommand are mutually exclusive")
+	case o.PasswordFile != "":
+		b, err := ioutil.ReadFile(o.PasswordFile)
+		if err != nil {
+			return o, fmt.Errorf("postdock: reading password file: %w", err)
+		}
+		o.DBPassword = strings.TrimSpace(string(b))
+	case o.PasswordCommand != "":
+		out, err := exec.Command("sh", "-c", o.PasswordCommand).Output()
+		if err != nil {
+			// Only stderr, stdout may hold part of the secret.
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				return o, fmt.Errorf("postdock: password command failed: %v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+			}
+			return o, fmt.Errorf("postdock: password command failed: %w", err)
+		}
+		o.DBPassword = strings.TrimSpace(string(out))
+	default:
+		return o, nil
+	}
+	if o.DBPassword == "" {
+		return o, errors.New("postdock: resolved password is empty")
+	}
+	return o, nil
+}
@@ -1,6 +1,7 @@
 // postdock package runs db-related commands either inside a docker container
 // or pulls and runs them inside a docker container. Example: postgres-11.8-alpine.
-// All docker commands are run with --rm, which means they are removed after exit.
+// All docker commands are run with --rm, which means they are removed after exit,
+// unless Options.KeepContainer is set for debugging.
 //
 // FYI, some functions use postgres as a database name. This is intentional since
 // the database your're trying to access may not exist yet. postgres is the default
@@ -11,37 +12,557 @@
 // psql or pg_dump. It is unlikely you will expose this outside your system, but be warned
 // about the usage of fmt.Sprintf. If you're unsure what this means, please read about
 // prepared statements and sql injection.
+//
+// All exported functions are safe to call concurrently from multiple goroutines,
+// with distinct Options or the same Options. Options is passed by value and the
+// package never modifies what its copies share with the caller: the slices and
+// maps, e.g. Volumes and Variables, are only read, so the caller must not modify
+// them while an operation runs either, use Options.Clone for a copy to modify.
+// Hook, OnOutput and DumpFilter are shared by all copies and called from every
+// goroutine using them, so they must be safe for concurrent use. Metrics is
+// shared as well and synchronizes itself. Operations against the same database
+// name are of course still subject to whatever postgres itself allows, e.g. a
+// concurrent Drop and Create of one database.
 package postdock
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bitfield/script"
 )
 
 var (
 	ErrDBNotExist = errors.New("db does not exists")
+	// ErrTerminatePermission is returned by Terminate when the user may not
+	// terminate the sessions of other users, as is common on managed databases
+	// such as RDS where the user is not a superuser.
+	ErrTerminatePermission = errors.New("not permitted to terminate sessions")
+	// ErrTableNotExist is returned by CountRows when the table does not exist.
+	ErrTableNotExist = errors.New("table does not exist")
+	// ErrRemoteDocker is returned when a command needs to bind mount a host
+	// path, e.g. Import, but docker talks to a remote daemon where that path
+	// does not exist.
+	ErrRemoteDocker = errors.New("volume mounts require a local docker daemon")
+	// ErrClientTooOld is returned when pg_dump in DockerImage is older than
+	// the server, which pg_dump refuses to dump.
+	ErrClientTooOld = errors.New("client version older than server")
+
+	// ErrRegistryAuth is returned when pulling DockerImage fails because the
+	// registry requires (different) credentials. See Options.RegistryAuth.
+	ErrRegistryAuth = errors.New("registry authentication failed")
+	// ErrImageNotFound is returned when DockerImage does not exist in the registry.
+	ErrImageNotFound = errors.New("image not found")
+	// ErrDockerNotInstalled is returned when a command needs docker, but the
+	// docker CLI is not in PATH.
+	ErrDockerNotInstalled = errors.New("docker is not installed")
+	// ErrDockerDaemonUnavailable is returned when the docker CLI cannot reach
+	// the docker daemon, e.g. because it is not running.
+	ErrDockerDaemonUnavailable = errors.New("docker daemon is unavailable")
+	// ErrMissingTool is returned by ValidateImage when DockerImage lacks one
+	// of the client tools, e.g. a server-only or minimal custom image.
+	ErrMissingTool = errors.New("client tool not found")
+	// ErrRoleNotExist is returned by Create and ApplyGrants when the role to
+	// grant privileges to does not exist.
+	ErrRoleNotExist = errors.New("role does not exist")
+	// ErrServerBusy is returned when the server has no connection slots left,
+	// e.g. "too many clients already" because of max_connections, or runs
+	// out of shared memory, e.g. under the load of a parallel test suite.
+	// See Options.BusyRetries.
+	ErrServerBusy = errors.New("server busy")
+	// ErrTemplateIncompatible is returned by Create when Options.Template has
+	// a different encoding or locale than the database to create.
+	ErrTemplateIncompatible = errors.New("template database has an incompatible encoding or locale")
+	// ErrLocaleNotAvailable is returned by Create when the server does not
+	// have the en_US.UTF-8 locale, see Options.InheritLocale.
+	ErrLocaleNotAvailable = errors.New("locale not available")
+
+	// ErrAuthFailed is returned by Authenticate when the server rejects
+	// DBUser or DBPassword.
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrConnectionRefused is returned by Authenticate when the server cannot
+	// be reached at DBHost and DBPort.
+	ErrConnectionRefused = errors.New("connection refused")
 )
 
 type Options struct {
-	DockerImage   string
-	DockerNetwork string
-	dockerVolume  string
+	DockerImage   string `json:"docker_image"`
+	DockerNetwork string `json:"docker_network"`
+
+	DBName string `json:"db_name"`
+	// DBHost is a hostname or IP address, or for unix socket connections the
+	// directory containing the socket, e.g. /var/run/postgresql. An IPv6
+	// address may be bracketed, e.g. [::1].
+	DBHost     string `json:"db_host"`
+	DBPort     int    `json:"db_port"`
+	DBUser     string `json:"db_user"`
+	DBPassword string `json:"db_password"`
+	// PasswordFile and PasswordCommand are alternatives to DBPassword, e.g.
+	// for a file mounted by a secret manager or a command like "op read ...".
+	// The trimmed file contents or the command's output become DBPassword on
+	// ResolvePassword, which LoadOptions calls.
+	PasswordFile    string `json:"password_file"`
+	PasswordCommand string `json:"password_command"`
+	// DBOwner is the role owning the databases created by Create and receiving
+	// its privileges, while DBUser is only used to connect. Defaults to DBUser.
+	// DBUser, or AdminUser if set, must be a superuser or a member of DBOwner.
+	DBOwner string `json:"db_owner"`
+	// AdminUser and AdminPassword, if set, are used instead of DBUser and
+	// DBPassword to connect for the operations on the maintenance database
+	// which need elevated privileges: creating roles and databases, dropping
+	// databases and terminating sessions. DBUser then is the application role,
+	// which Create still creates and makes the default DBOwner.
+	AdminUser     string `json:"admin_user"`
+	AdminPassword string `json:"admin_password"`
+
+	Debug bool `json:"debug"`
+
+	// DryRun builds every command but does not execute it. Instead, the
+	// command that would have run is logged with the password redacted,
+	// making it easy to reproduce an operation by hand.
+	DryRun bool `json:"dry_run"`
+
+	// Hook, if set, is notified around each exported operation. It is called
+	// from the goroutine running the operation, so it must be safe for
+	// concurrent use if operations run concurrently.
+	Hook Hook `json:"-"`
+	// Metrics, if set, records how long pulls, commands and operations took.
+	// It may be shared by concurrent operations.
+	Metrics *Metrics `json:"-"`
+
+	// RegistryAuth, if set, is used to docker login before pulling DockerImage.
+	// Leave nil to rely on the docker daemon's existing login or credential helpers.
+	RegistryAuth *RegistryAuth `json:"registry_auth"`
+
+	// PullPolicy controls when DockerImage is pulled. Defaults to PullAlways.
+	PullPolicy PullPolicy `json:"pull_policy"`
+	// Platform, e.g. linux/amd64, is passed as --platform to docker pull and
+	// docker run, e.g. for an amd64-only image on an arm64 machine. Defaults
+	// to the platform of the docker daemon.
+	Platform string `json:"platform"`
+	// ShmSize sets --shm-size of the container, e.g. 256m, for "could not
+	// resize shared memory segment" errors of parallel queries with the
+	// default of 64m. Defaults to the docker default.
+	ShmSize string `json:"shm_size"`
+
+	// SingleTransaction wraps the statements sent by Exec in a single
+	// transaction, so either all or none of them are applied.
+	SingleTransaction bool `json:"single_transaction"`
+
+	// ContinueOnError omits psql's ON_ERROR_STOP, so a failing statement does not
+	// abort the remaining ones. Useful for best-effort scripts or applying dumps
+	// which are not perfectly clean. By default psql stops on the first error.
+	ContinueOnError bool `json:"continue_on_error"`
+	// IgnoreErrors lists SQLSTATE codes, e.g. 42710 for duplicate_object, or
+	// two character classes, e.g. 42, which psql continues past like with
+	// ContinueOnError. Any other error still fails the command, but only once
+	// psql has finished. Not useful with SingleTransaction, where any error
+	// aborts the transaction.
+	IgnoreErrors []string `json:"ignore_errors"`
+
+	// KeepContainer runs the docker container without --rm, so it is left behind
+	// after the command exits and can be inspected with docker logs or docker
+	// exec. The caller is responsible for removing it. ContainerName optionally
+	// gives it a predictable name, in which case a leftover container with that
+	// name must be removed before the next command can run.
+	KeepContainer bool   `json:"keep_container"`
+	ContainerName string `json:"container_name"`
+
+	// NetworkAlias and Hostname set --network-alias and --hostname on the
+	// container, so it can be addressed by name by other containers on
+	// DockerNetwork. A network alias requires a user-defined network.
+	NetworkAlias string `json:"network_alias"`
+	Hostname     string `json:"hostname"`
+
+	// RunAsCurrentUser runs the container with the uid and gid of the current
+	// process instead of root, so files written to a mounted volume, e.g. by a
+	// dump, are owned by the current user and can be cleaned up without root.
+	RunAsCurrentUser bool `json:"run_as_current_user"`
+
+	// SQLDriver is the name of a registered database/sql driver, e.g. "pgx" or
+	// "postgres", the caller must import it. When set, plain queries such as
+	// those of Create, Exists, Drop or QueryScalar run directly over
+	// database/sql, which is much faster than starting psql in a container.
+	// Commands which need the client tools, like Import and SchemaDump, still
+	// run psql or pg_dump as usual.
+	SQLDriver string `json:"sql_driver"`
+
+	// SkipTerminate makes Drop, and therefore Import, skip terminating existing
+	// sessions. Useful on locked-down databases where Terminate is not
+	// permitted, the drop then fails if the database is still in use.
+	SkipTerminate bool `json:"skip_terminate"`
+	// SkipGrants makes Create, and therefore Import, and ResetMany leave the
+	// privileges of new databases alone, for platforms where grants are
+	// managed elsewhere or ALTER DEFAULT PRIVILEGES is not permitted. The
+	// roles, databases and Schemas are still created.
+	SkipGrants bool `json:"skip_grants"`
+
+	// TransactionScope controls how ImportDir wraps files in transactions.
+	TransactionScope TransactionScope `json:"transaction_scope"`
+	// ImportJobs is the number of files ImportDir applies concurrently, each
+	// in its own psql session, defaults to 1. Only set it for files which do
+	// not depend on each other, e.g. fixtures of unrelated tables, since they
+	// no longer run in lexical order. It cannot be combined with
+	// TransactionWholeBatch.
+	ImportJobs int `json:"import_jobs"`
+
+	// StatementTimeout, if set, caps how long any single statement may run on
+	// the server. It is set as a connection option, so it applies to the same
+	// session as the work. Note pg_dump disables it for its own session and
+	// some maintenance commands may not honor it.
+	StatementTimeout time.Duration `json:"statement_timeout"`
+
+	// KeepDumpHeader keeps the comment header of pg_dump, with the pg_dump and
+	// server versions, in the output of SchemaDump.
+	KeepDumpHeader bool `json:"keep_dump_header"`
+	// KeepDumpSettings lists the SET statements to keep in the output of
+	// SchemaDump by setting name, e.g. "client_encoding" or "search_path". Use
+	// "*" to keep all of them. By default they are all removed.
+	KeepDumpSettings []string `json:"keep_dump_settings"`
+	// DumpFilter, if set, decides which statements of SchemaDump to keep,
+	// instead of DefaultDumpFilter, which drops all privileges, ownership and
+	// comments. It is called with each line left after KeepDumpHeader and
+	// KeepDumpSettings, and the line is kept if it returns true, e.g. to keep
+	// the grants to a read-only role:
+	//
+	//	func(line string) bool {
+	//		return strings.HasSuffix(line, " TO readonly;") || postdock.DefaultDumpFilter(line)
+	//	}
+	DumpFilter func(line string) bool `json:"-"`
+
+	// ReadOnly makes the sessions of the read-only helpers, such as QueryScalar,
+	// CountRows, Exists and ServerVersion, use default_transaction_read_only, so
+	// an accidental write fails. Useful when pointing at a live database for
+	// diagnostics. It does not affect Create, Drop, Import and the like.
+	ReadOnly bool `json:"read_only"`
+	// readOnlySession is set by reader for the read-only helpers.
+	readOnlySession bool
+	// secrets are redacted in addition to the passwords above, e.g. those of
+	// another Options whose command runs in the same container.
+	secrets []string
+	// passFileEntries are written to the pgpass file in addition to the
+	// credentials above, see UsePassFile.
+	passFileEntries []string
+	// deadline is when the operation started by trace times out, see Timeout.
+	deadline time.Time
+	// boundOutput is set by bounded.
+	boundOutput bool
+	// op and dbName are those of the innermost operation, set by trace.
+	op, dbName string
+
+	// OnOutput, if set, is called with each line of output of a command as it
+	// is produced, e.g. to show the progress of a long import. Passwords are
+	// redacted. The output is still returned as usual.
+	OnOutput func(line string) `json:"-"`
+
+	// PsqlPath, PgDumpPath and PgRestorePath override the client tools to
+	// run, e.g. /usr/lib/postgresql/16/bin/pg_dump when several versions are
+	// installed. They default to psql, pg_dump and pg_restore on the PATH.
+	// The package never runs pg_dumpall, so it has no path of its own.
+	PsqlPath      string `json:"psql_path"`
+	PgDumpPath    string `json:"pg_dump_path"`
+	PgRestorePath string `json:"pg_restore_path"`
+
+	// MaxErrorOutput caps how many bytes of a failed command's output end up
+	// in the returned error, keeping its beginning and its end, where the
+	// actual error usually is. It also caps the output kept in memory for
+	// commands whose output may be huge but is not parsed, e.g. of Import or
+	// Restore, while they run. Defaults to 64KB, a negative value disables
+	// the limit.
+	MaxErrorOutput int `json:"max_error_output"`
+
+	// Variables are passed to psql as -v name=value, for scripts using psql
+	// variables such as :schema or :'password'. Names may only contain letters,
+	// digits and underscores.
+	Variables map[string]string `json:"variables"`
+	// NoMetaCommands makes ApplySQL send the sql to the server as is, without
+	// psql interpreting backslash meta-commands or variables. psql has no such
+	// switch for files, so this sends the sql as a single -c command string:
+	// it runs as one implicit transaction and is limited by the maximum
+	// command line length.
+	NoMetaCommands bool `json:"no_meta_commands"`
+	// ImportOverStdin makes Import stream the sql file to psql over stdin
+	// instead of mounting its directory into the container, for remote or
+	// rootless docker where bind mounts are unavailable. Import falls back to
+	// it automatically for a remote docker daemon. Relative \i includes do not
+	// work this way.
+	ImportOverStdin bool `json:"import_over_stdin"`
+	// CopyFiles copies the files of Import, Dump, Restore and the like into
+	// the container with docker cp instead of bind mounting their directory,
+	// and copies the directory back afterwards, e.g. with the output of Dump.
+	// Unlike ImportOverStdin, it works with every function, including
+	// directory archives, on remote and rootless docker. The container is
+	// created, started and then removed. Since the whole directory is copied
+	// both ways, keep the files in a directory of their own. Volumes are
+	// still bind mounted.
+	CopyFiles bool `json:"copy_files"`
+	// PsqlExtraArgs are passed to every psql command like
+	// DumpOptions.ExtraArgs, e.g. --echo-errors.
+	PsqlExtraArgs []string `json:"psql_extra_args"`
+
+	// DatabaseSettings are applied by Create to a newly created database with
+	// ALTER DATABASE SET, e.g. "search_path": "app, public" or "timezone":
+	// "UTC". The values of list settings, such as search_path, are split on
+	// commas, any other value is passed as a single string.
+	DatabaseSettings map[string]string `json:"database_settings"`
+	// Schemas are created by Create in a new database, owned by DBOwner, and
+	// receive the same grants as public. Unless DatabaseSettings has one, the
+	// search_path of the database becomes the schemas followed by public.
+	// Names must be lower case identifiers.
+	Schemas []string `json:"schemas"`
+	// Template is the database Create copies, defaults to template0. Unlike
+	// template0, other templates, such as template1 or a custom seeded one,
+	// must already use the UTF-8 encoding and the locale of Create, see
+	// InheritLocale.
+	Template string `json:"template"`
+	// InheritLocale leaves out the LC_COLLATE and LC_CTYPE clauses of Create,
+	// so databases use the locale of the server instead of en_US.UTF-8. Set it
+	// for images without that locale, such as the alpine ones.
+	InheritLocale bool `json:"inherit_locale"`
+
+	// Timeout limits how long each exported operation may take, including the
+	// operations it runs itself, e.g. the Drop and Create of Import. Every
+	// command still running once it passes, including docker pull, is killed
+	// and the error wraps context.DeadlineExceeded, see TimeoutError. Zero
+	// means no limit. Note a killed docker client may leave a KeepContainer
+	// container running.
+	Timeout time.Duration `json:"timeout"`
+	// BusyRetries is how often a command is retried when the server refuses
+	// the connection with ErrServerBusy, waiting BusyBackoff, 500ms by
+	// default, before the first retry and twice as long before each next one.
+	// Only refused connections are retried, since nothing ran yet; commands
+	// reading stdin and out of shared memory errors are not. Containers of
+	// the postgres image allow 100 connections by default, which parallel
+	// test suites easily exceed; raise it with postgres -c max_connections=
+	// rather than relying on retries alone.
+	BusyRetries int           `json:"busy_retries"`
+	BusyBackoff time.Duration `json:"busy_backoff"`
+
+	// Shell runs commands inside the container as Shell -c <command>, for
+	// images where sh is missing or behaves differently. Defaults to sh.
+	Shell string `json:"shell"`
+	// Workdir sets the working directory of the container. Files of Import
+	// and friends are mounted below it, so relative paths keep working.
+	// Defaults to the working directory of DockerImage, usually /.
+	Workdir string `json:"workdir"`
+
+	// ForceLocal runs commands directly instead of in a new container of
+	// DockerImage, as is done automatically when running inside a container,
+	// and ForceDocker always runs them in a new container. Use these when the
+	// automatic detection is wrong, see UsesDocker.
+	ForceLocal  bool `json:"force_local"`
+	ForceDocker bool `json:"force_docker"`
+
+	// Volumes are additional bind mounts for the container, each of the form
+	// host:container[:ro], e.g. for CA certificates or files included with
+	// \i. The container path must be absolute. They are ignored when commands
+	// run directly, see UsesDocker.
+	Volumes []string `json:"volumes"`
+
+	// UsePassFile passes the password to psql and pg_dump in a temporary
+	// pgpass file, readable only by the current user and removed after each
+	// command, rather than in PGPASSWORD where it is visible in the process
+	// list. In a container the file is mounted read-only.
+	UsePassFile bool `json:"use_pass_file"`
+}
+
+// PullPolicy controls when DockerImage is pulled before running a command.
+type PullPolicy int
+
+const (
+	// PullAlways pulls the image before every command.
+	PullAlways PullPolicy = iota
+	// PullIfNotPresent only pulls the image if it is not available locally.
+	// For a digest reference, e.g. postgres@sha256:..., the local image must
+	// match the digest.
+	PullIfNotPresent
+	// PullNever never pulls the image, it must already be available locally.
+	PullNever
+)
+
+// imageRef matches a docker image reference: an optional registry host, a
+// repository path and an optional tag and/or sha256 digest. Examples:
+// postgres:12-alpine, ghcr.io/org/pg:12 and postgres@sha256:<64 hex chars>.
+var imageRef = regexp.MustCompile(`^(?:[a-zA-Z0-9.-]+(?::[0-9]+)?/)?` +
+	`[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*` +
+	`(?::[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127})?(?:@sha256:[a-f0-9]{64})?$`)
+
+// variableName matches the psql variable names accepted in Options.Variables.
+var variableName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// schemaName matches the schema names accepted in Options.Schemas, which are
+// used unquoted.
+var schemaName = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// platform matches Options.Platform, e.g. linux/amd64 or linux/arm64/v8.
+var platform = regexp.MustCompile(`^[a-z0-9_]+/[a-z0-9_]+(?:/[a-z0-9_]+)?$`)
+
+// shmSize matches Options.ShmSize, a number with an optional unit.
+var shmSize = regexp.MustCompile(`^[0-9]+[bkmgBKMG]?$`)
+
+// sqlState matches a SQLSTATE code or class in Options.IgnoreErrors.
+var sqlState = regexp.MustCompile(`^[0-9A-Z]{2}(?:[0-9A-Z]{3})?$`)
+
+// settingName matches the parameter names accepted in Options.DatabaseSettings,
+// including custom ones such as app.tenant.
+var settingName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*(?:\.[a-zA-Z_][a-zA-Z0-9_]*)?$`)
+
+// RegistryAuth holds credentials for pulling DockerImage from a private registry.
+type RegistryAuth struct {
+	// Server is the registry to log in to, e.g. ghcr.io. Defaults to the
+	// registry host of DockerImage, or Docker Hub if there is none.
+	Server   string `json:"server"`
+	Username string `json:"username"`
+	// Password may also be an access token, if the registry supports it.
+	Password string `json:"password"`
+}
+
+// Hook receives events around each exported operation, e.g. to record metrics
+// or tracing spans without this package depending on a particular library. op
+// is the name of the operation, such as "Create" or "Drop". Operations which
+// call other operations, like Import, emit nested events.
+type Hook interface {
+	OnStart(op, dbName string)
+	OnFinish(op, dbName string, dur time.Duration, err error)
+}
+
+// CommandHook may be implemented by a Hook to also be notified after each
+// command an operation runs, e.g. to record a span per psql invocation. It is
+// not notified in DryRun mode, where nothing runs.
+type CommandHook interface {
+	Hook
+	OnCommand(e CommandEvent)
+}
+
+// CommandEvent describes a command run by an operation.
+type CommandEvent struct {
+	// Op and DBName are those of the innermost operation running the
+	// command, as passed to Hook.OnStart.
+	Op     string
+	DBName string
+	// Name is the name of the program run, e.g. psql or pg_dump.
+	Name string
+	// Command is the command line, with the passwords redacted. It does not
+	// include the docker run wrapping it, if any.
+	Command  string
+	Duration time.Duration
+	Err      error
+}
+
+// normalize returns o with defaults applied. It is the single place for
+// defaults, any command builder should use the normalized Options.
+func (o Options) normalize() Options {
+	if o.DBPort == 0 {
+		// Respect PGPORT like psql would, but be explicit about it since the
+		// container does not inherit the environment.
+		if port, err := strconv.Atoi(os.Getenv("PGPORT")); err == nil && port > 0 {
+			o.DBPort = port
+		} else {
+			o.DBPort = 5432
+		}
+	}
+	if o.DBOwner == "" {
+		o.DBOwner = o.DBUser
+	}
+	// libpq expects IPv6 addresses bare, tolerate one bracketed as in a URL.
+	if strings.HasPrefix(o.DBHost, "[") && strings.HasSuffix(o.DBHost, "]") {
+		o.DBHost = o.DBHost[1 : len(o.DBHost)-1]
+	}
+	if o.Template == "" {
+		o.Template = "template0"
+	}
+	if o.MaxErrorOutput == 0 {
+		o.MaxErrorOutput = 64 << 10
+	}
+	if o.PsqlPath == "" {
+		o.PsqlPath = "psql"
+	}
+	if o.PgDumpPath == "" {
+		o.PgDumpPath = "pg_dump"
+	}
+	if o.PgRestorePath == "" {
+		o.PgRestorePath = "pg_restore"
+	}
+	if o.Shell == "" {
+		o.Shell = "sh"
+	}
+	return o
+}
+
+// Clone returns a deep copy of o, which shares nothing mutable with o
+// except for the Hook, OnOutput and DumpFilter callbacks and Metrics.
+func (o Options) Clone() Options {
+	if o.RegistryAuth != nil {
+		auth := *o.RegistryAuth
+		o.RegistryAuth = &auth
+	}
+	o.KeepDumpSettings = append([]string(nil), o.KeepDumpSettings...)
+	o.Volumes = append([]string(nil), o.Volumes...)
+	o.IgnoreErrors = append([]string(nil), o.IgnoreErrors...)
+	o.Schemas = append([]string(nil), o.Schemas...)
+	o.PsqlExtraArgs = append([]string(nil), o.PsqlExtraArgs...)
+	o.Variables = cloneMap(o.Variables)
+	o.DatabaseSettings = cloneMap(o.DatabaseSettings)
+	o.secrets = append([]string(nil), o.secrets...)
+	o.passFileEntries = append([]string(nil), o.passFileEntries...)
+	return o
+}
+
+func cloneMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// admin returns o for connecting as AdminUser, if set, to the maintenance
+// database. DBOwner keeps defaulting to the application role DBUser. It is
+// safe to call repeatedly.
+func (o Options) admin() Options {
+	if o.AdminUser == "" {
+		return o
+	}
+	o.DBOwner = o.normalize().DBOwner
+	if o.DBUser != o.AdminUser && o.DBPassword != "" {
+		o.secrets = append(append([]string(nil), o.secrets...), o.DBPassword)
+	}
+	o.DBUser = o.AdminUser
+	o.DBPassword = o.AdminPassword
+	return o
+}
 
-	DBName     string
-	DBHost     string
-	DBPort     int
-	DBUser     string
-	DBPassword string
+// bounded returns o for a command whose output is not parsed and may be
+// huge, e.g. psql echoing a command tag for each statement of an import, so
+// only the beginning and end of it are kept, see MaxErrorOutput.
+func (o Options) bounded() Options {
+	o.boundOutput = true
+	return o
+}
 
-	Debug bool
+// reader returns o for use by a read-only helper.
+func (o Options) reader() Options {
+	o.readOnlySession = o.ReadOnly
+	return o
 }
 
 func (o Options) isValid(dbName string) error {
@@ -56,329 +577,2330 @@ func (o Options) isValid(dbName string) error {
 		return errors.New("postdock: required option: db user")
 	}
 	if o.DBPassword == "" {
+		if o.PasswordFile != "" || o.PasswordCommand != "" {
+			return errors.New("postdock: password not resolved, call Options.ResolvePassword first")
+		}
 		return errors.New("postdock: required option: db password")
 	}
+	for _, v := range o.Volumes {
+		if err := validVolume(v); err != nil {
+			return err
+		}
+	}
+	for _, code := range o.IgnoreErrors {
+		if !sqlState.MatchString(code) {
+			return fmt.Errorf("postdock: invalid SQLSTATE code or class: %q", code)
+		}
+	}
+	if _, err := extraArgs(o.PsqlExtraArgs); err != nil {
+		return err
+	}
+	if o.Template != "" && !variableName.MatchString(o.Template) {
+		return fmt.Errorf("postdock: invalid template database name: %q", o.Template)
+	}
+	for _, s := range o.Schemas {
+		if !schemaName.MatchString(s) {
+			return fmt.Errorf("postdock: invalid schema name: %q", s)
+		}
+	}
+	if o.BusyRetries < 0 {
+		return fmt.Errorf("postdock: invalid number of busy retries: %d", o.BusyRetries)
+	}
+	if o.ShmSize != "" && !shmSize.MatchString(o.ShmSize) {
+		return fmt.Errorf("postdock: invalid shm size: %q", o.ShmSize)
+	}
+	if o.Platform != "" && !platform.MatchString(o.Platform) {
+		return fmt.Errorf("postdock: invalid platform: %q", o.Platform)
+	}
+	if o.ForceLocal && o.ForceDocker {
+		return errors.New("postdock: ForceLocal and ForceDocker are mutually exclusive")
+	}
+	if o.AdminUser != "" && o.AdminPassword == "" {
+		return errors.New("postdock: required option: admin password")
+	}
 
 	if o.DockerImage == "" {
 		return errors.New("postdock: required option: docker base image (ex: postgres:11.7-alpine")
 	}
+	if !imageRef.MatchString(o.DockerImage) {
+		return fmt.Errorf("postdock: invalid docker image reference: %q", o.DockerImage)
+	}
+	for name := range o.Variables {
+		if !variableName.MatchString(name) {
+			return fmt.Errorf("postdock: invalid psql variable name: %q", name)
+		}
+	}
+	for name := range o.DatabaseSettings {
+		if !settingName.MatchString(name) {
+			return fmt.Errorf("postdock: invalid database setting name: %q", name)
+		}
+	}
 
 	return nil
 }
 
-func Create(dbName string, opt Options) error {
+// validVolume checks v is of the form host:container[:ro] or :rw.
+func validVolume(v string) error {
+	s := strings.TrimSuffix(strings.TrimSuffix(v, ":ro"), ":rw")
+	i := strings.LastIndex(s, ":")
+	if i <= 0 || !strings.HasPrefix(s[i+1:], "/") {
+		return fmt.Errorf("postdock: invalid volume %q, expected host:container[:ro] with an absolute container path", v)
+	}
+	return nil
+}
+
+// URL returns a postgres connection URL for dbName, e.g. for handing to a
+// database/sql driver or another tool. IPv6 hosts are bracketed, e.g.
+// postgres://user:pass@[::1]:5432/db, and unix socket directories are passed
+// as the host query parameter. Note the URL contains the password.
+func (o Options) URL(dbName string) string {
+	o = o.normalize()
+	port := o.DBPort
+	u := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(o.DBUser, o.DBPassword),
+		Path:   "/" + dbName,
+	}
+	query := url.Values{}
+	if isSocket(o.DBHost) {
+		query.Set("host", o.DBHost)
+		query.Set("port", strconv.Itoa(port))
+	} else {
+		// JoinHostPort brackets IPv6 addresses, unlike the -h flag of psql
+		// where libpq expects them bare.
+		u.Host = net.JoinHostPort(o.DBHost, strconv.Itoa(port))
+	}
+	if opts := connOptions(o); opts != "" {
+		query.Set("options", opts)
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// ConnInfo are the connection parameters psql and pg_dump use, after
+// defaults are applied. It excludes the password.
+type ConnInfo struct {
+	Host    string
+	Port    string
+	User    string
+	DBName  string
+	SSLMode string
+}
+
+// ConnInfo returns the effective connection parameters for dbName, e.g. to
+// log them or hand them to another tool. Options has no sslmode of its own,
+// so SSLMode is that of the PGSSLMODE environment variable when commands run
+// locally, and otherwise the libpq default, prefer.
+func (o Options) ConnInfo(dbName string) ConnInfo {
+	o = o.normalize()
+	sslMode := "prefer"
+	if mode := os.Getenv("PGSSLMODE"); mode != "" && o.local() {
+		sslMode = mode
+	}
+	return ConnInfo{
+		Host:    o.DBHost,
+		Port:    strconv.Itoa(o.DBPort),
+		User:    o.DBUser,
+		DBName:  dbName,
+		SSLMode: sslMode,
+	}
+}
+
+// Create creates the roles of opt, dbName and grants DBOwner the privileges
+// on it, skipping what exists already, so it is idempotent. The steps are
+// available separately as CreateRole, CreateDatabase and ApplyGrants, e.g.
+// to create the roles once with a privileged admin and the databases later
+// with less privileges.
+func Create(dbName string, opt Options) (err error) {
+	defer trace("Create", dbName, &opt)(&err)
+
 	if err := opt.isValid(dbName); err != nil {
 		return err
 	}
+	if err := createRoles(opt); err != nil {
+		return err
+	}
+	created, err := createDatabase(dbName, opt)
+	// An existing database, even one created by a concurrent Create, keeps
+	// its privileges.
+	if err != nil || !created || opt.SkipGrants {
+		return err
+	}
 
-	q := fmt.Sprintf("SELECT EXISTS ( SELECT usename FROM pg_catalog.pg_user WHERE usename = '%s');", opt.DBUser)
-	cmd := psql("postgres", q, opt)
-	out, err := run(cmd, opt)
-	if err != nil {
+	return applyGrants(dbName, grantSchemas(opt), opt)
+}
+
+// CreateRole creates the DBUser role with DBPassword, and DBOwner if it
+// differs, unless they exist. It is the first step of Create.
+func CreateRole(opt Options) (err error) {
+	defer trace("CreateRole", "", &opt)(&err)
+
+	if err := opt.isValid("postgres"); err != nil {
 		return err
 	}
-	exists, err := strconv.ParseBool(out)
-	if err != nil {
+
+	return createRoles(opt)
+}
+
+// CreateDatabase creates dbName owned by DBOwner with DatabaseSettings and
+// Schemas, unless it exists. It is the second step of Create, without the
+// roles, which must exist, and without the grants, see ApplyGrants.
+func CreateDatabase(dbName string, opt Options) (err error) {
+	defer trace("CreateDatabase", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
 		return err
 	}
-	if !exists {
-		q = fmt.Sprintf("CREATE USER %s WITH PASSWORD '%s';", opt.DBUser, opt.DBPassword)
-		cmd := psql("postgres", q, opt)
-		out, err := run(cmd, opt)
-		if err != nil {
-			return err
-		}
+
+	_, err = createDatabase(dbName, opt)
+	return err
+}
+
+// createDatabase implements CreateDatabase and reports whether it created
+// dbName.
+func createDatabase(dbName string, opt Options) (bool, error) {
+	adm := opt.admin()
+	owner := adm.normalize().DBOwner
+
+	// Only continue creating a DB if one does not already exists, but do not fail otherwise, this function
+	// should be idempotent. Concurrent calls may still race past this check, which is handled below.
+	if err := Exists(dbName, adm); err == nil {
 		if opt.Debug {
-			log.Printf("[%s]: successfully created user:%s", out, opt.DBUser)
+			log.Printf("skipping creating existing database:%s", dbName)
 		}
+		return false, nil
 	}
 
-	// Only continue creating a DB if one does not already exists, but do not fail otherwise, this function
-	// should be idempotent.
-	if err := Exists(dbName, opt); err == nil {
+	out, err := execQuery("postgres", createDatabaseQuery(dbName, adm), adm)
+	if isDuplicate(err) {
+		// Lost the race against a concurrent Create, which also applies the
+		// privileges.
 		if opt.Debug {
 			log.Printf("skipping creating existing database:%s", dbName)
 		}
-		return nil
+		return false, nil
 	}
-
-	q = fmt.Sprintf("CREATE DATABASE %s ENCODING 'UTF-8' LC_COLLATE='en_US.UTF-8' LC_CTYPE='en_US.UTF-8' TEMPLATE template0 OWNER %s;",
-		dbName, opt.DBUser)
-	cmd = psql("postgres", q, opt)
-	out, err = run(cmd, opt)
 	if err != nil {
-		return err
+		return false, createDatabaseError(err, adm)
 	}
 	if opt.Debug {
 		log.Printf("[%s]: successfully created database:%s", out, dbName)
 	}
+	if err := alterDatabaseSettings(dbName, adm); err != nil {
+		return true, err
+	}
+	if len(opt.Schemas) > 0 {
+		if _, err := execQuery(dbName, strings.Join(schemaQueries(owner, opt), "; "), adm); err != nil {
+			return true, err
+		}
+		if opt.Debug {
+			log.Printf("successfully created schemas %v in db:%s", opt.Schemas, dbName)
+		}
+	}
 
+	return true, nil
+}
+
+// schemaQueries returns the statements creating opt.Schemas.
+func schemaQueries(owner string, opt Options) []string {
 	var queries []string
-	for _, q := range []string{
-		"GRANT ALL PRIVILEGES ON ALL TABLES IN SCHEMA public TO %s",
-		"GRANT ALL PRIVILEGES ON ALL SEQUENCES IN SCHEMA public TO %s",
-		"ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT ALL PRIVILEGES ON TABLES TO %s",
-		"ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT ALL PRIVILEGES ON SEQUENCES TO %s",
-	} {
-		queries = append(queries, fmt.Sprintf(q, opt.DBUser))
+	for _, s := range opt.Schemas {
+		queries = append(queries, fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s AUTHORIZATION %s", s, owner))
+	}
+	return queries
+}
+
+// grantSchemas returns the schemas Create grants privileges on.
+func grantSchemas(opt Options) []string {
+	if len(opt.Schemas) == 0 {
+		return nil
+	}
+	return append([]string{"public"}, opt.Schemas...)
+}
+
+// EnsureDatabase is a leaner Create for the hot path of test setup: it only
+// checks whether dbName exists and creates it if not, owned by DBOwner. Unlike
+// Create it neither creates roles, which must exist already, nor applies the
+// grants. DatabaseSettings, if any, are still applied.
+func EnsureDatabase(dbName string, opt Options) (err error) {
+	defer trace("EnsureDatabase", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return err
 	}
+	adm := opt.admin()
 
-	cmd = psql(dbName, strings.Join(queries, "; "), opt)
-	if _, err = run(cmd, opt); err != nil {
+	if err := Exists(dbName, adm); err == nil {
+		return nil
+	} else if !errors.Is(err, ErrDBNotExist) {
 		return err
 	}
+	out, err := execQuery("postgres", createDatabaseQuery(dbName, adm), adm)
+	if isDuplicate(err) {
+		return nil
+	}
+	if err != nil {
+		return createDatabaseError(err, adm)
+	}
 	if opt.Debug {
-		log.Printf("successfully applied PRIVILEGES to user:%s on db:%s", opt.DBUser, dbName)
+		log.Printf("[%s]: successfully created database:%s", out, dbName)
 	}
 
-	return nil
+	return alterDatabaseSettings(dbName, adm)
 }
 
-func Exists(dbName string, opt Options) error {
-	if err := opt.isValid(dbName); err != nil {
-		return err
-	}
+// createRoles creates the DBUser and DBOwner roles of opt, unless they exist.
+func createRoles(opt Options) error {
+	// The application role DBUser is created by the admin, if any.
+	adm := opt.admin()
 
-	q := fmt.Sprintf("SELECT EXISTS ( SELECT datname FROM pg_database WHERE datname = '%s')", dbName)
-	cmd := psql("postgres", q, opt)
-	out, err := run(cmd, opt)
+	q := fmt.Sprintf("SELECT EXISTS ( SELECT usename FROM pg_catalog.pg_user WHERE usename = '%s');", opt.DBUser)
+	out, err := queryScalar("postgres", q, adm)
 	if err != nil {
 		return err
 	}
-	exists, err := strconv.ParseBool(out)
+	exists, err := parseBool(out, opt)
 	if err != nil {
 		return err
 	}
-	if exists {
-		if opt.Debug {
-			log.Printf("skipping creating db:%s exists", dbName)
+	if !exists {
+		q = fmt.Sprintf("CREATE USER %s WITH PASSWORD %s;", opt.DBUser, quoteLiteral(opt.DBPassword))
+		out, err := execQuery("postgres", q, adm)
+		switch {
+		case isDuplicate(err):
+			// Created concurrently by someone else since the check above.
+			if opt.Debug {
+				log.Printf("skipping creating existing user:%s", opt.DBUser)
+			}
+		case err != nil:
+			return err
+		case opt.Debug:
+			log.Printf("[%s]: successfully created user:%s", out, opt.DBUser)
 		}
-		return nil
 	}
+	if owner := adm.normalize().DBOwner; owner != opt.DBUser {
+		return createRole(owner, adm)
+	}
+	return nil
+}
 
-	return fmt.Errorf("%s: %w", dbName, ErrDBNotExist)
+// createDatabaseQuery returns the statement creating dbName as configured by o.
+func createDatabaseQuery(dbName string, o Options) string {
+	o = o.normalize()
+	locale := " LC_COLLATE='en_US.UTF-8' LC_CTYPE='en_US.UTF-8'"
+	if o.InheritLocale {
+		locale = ""
+	}
+	return fmt.Sprintf("CREATE DATABASE %s ENCODING 'UTF-8'%s TEMPLATE %s OWNER %s;",
+		dbName, locale, o.Template, o.DBOwner)
+}
+
+// createDatabaseError returns a clearer error for CREATE DATABASE failing
+// because of a missing locale or an incompatible template, or err as is.
+func createDatabaseError(err error, o Options) error {
+	msg := err.Error()
+	if strings.Contains(msg, "invalid locale name") {
+		return fmt.Errorf("postdock: %w: the server has no en_US.UTF-8 locale, as on alpine images, set InheritLocale to use the locale of the server: %v",
+			ErrLocaleNotAvailable, err)
+	}
+	if strings.Contains(msg, "incompatible with the encoding of the template database") ||
+		strings.Contains(msg, "incompatible with the collation of the template database") ||
+		strings.Contains(msg, "incompatible with the ctype of the template database") {
+		return fmt.Errorf("postdock: %w: %s, use template0 or a template with the UTF-8 encoding and en_US.UTF-8 locale: %v",
+			ErrTemplateIncompatible, o.normalize().Template, err)
+	}
+	return err
 }
 
-func Terminate(dbName string, opt Options) error {
+// ApplyGrants grants DBOwner all privileges on the existing tables and
+// sequences of the given schemas, defaulting to public, and on those created
+// later by DBUser or DBOwner. It runs as AdminUser, if set. Create does this
+// for a new database; ApplyGrants re-runs it, e.g. after an import created
+// tables as another role. It is safe to call repeatedly.
+func ApplyGrants(dbName string, schemas []string, opt Options) (err error) {
+	defer trace("ApplyGrants", dbName, &opt)(&err)
+
 	if err := opt.isValid(dbName); err != nil {
 		return err
 	}
+	return applyGrants(dbName, schemas, opt)
+}
 
-	q := fmt.Sprintf("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = '%s';", dbName)
-	cmd := psql("postgres", q, opt)
-	out, err := run(cmd, opt)
+// applyGrants implements ApplyGrants, running as AdminUser if set.
+func applyGrants(dbName string, schemas []string, opt Options) error {
+	owner := opt.normalize().DBOwner
+	creators := grantCreators(opt)
+	opt = opt.admin()
+	// Role names are used unquoted and so folded to lower case, which may
+	// not be the role found by the case-sensitive checks in createRoles.
+	q := fmt.Sprintf("SELECT EXISTS ( SELECT rolname FROM pg_catalog.pg_roles WHERE rolname = lower(%s));", quoteLiteral(owner))
+	out, err := queryScalar(dbName, q, opt)
 	if err != nil {
 		return err
 	}
+	exists, err := parseBool(out, opt)
+	if err != nil {
+		return err
+	}
+	if !exists && !opt.DryRun {
+		return fmt.Errorf("postdock: cannot grant privileges to %s: %w (unquoted role names are lower-cased)",
+			owner, ErrRoleNotExist)
+	}
+	version, err := ServerVersion(opt)
+	if err != nil {
+		return err
+	}
+	queries := grantQueries(schemas, owner, creators, version)
 
+	if _, err = execQuery(dbName, strings.Join(queries, "; "), opt); err != nil {
+		return err
+	}
 	if opt.Debug {
-		log.Printf("[%s]: terminate db:%s errors:%v", out, dbName, err)
+		log.Printf("successfully applied PRIVILEGES to user:%s on db:%s", owner, dbName)
 	}
 
 	return nil
 }
 
-func Drop(dbName string, opt Options) error {
-	if err := Terminate(dbName, opt); err != nil {
-		return err
+// grantCreators returns the roles whose objects created later ApplyGrants
+// grants privileges on: DBUser, the application role, and DBOwner if it
+// differs. Without FOR ROLE, ALTER DEFAULT PRIVILEGES would only cover the
+// objects of the role running it, which is AdminUser if set.
+func grantCreators(opt Options) string {
+	o := opt.normalize()
+	if strings.EqualFold(o.DBOwner, o.DBUser) {
+		return o.DBOwner
 	}
+	return o.DBOwner + ", " + o.DBUser
+}
 
-	q := fmt.Sprintf("DROP DATABASE IF EXISTS %s;", dbName)
-	cmd := psql("postgres", q, opt)
-	out, err := run(cmd, opt)
-	if err != nil {
-		return err
+// grantQueries returns the statements of ApplyGrants for a server of the
+// given version. creators are the roles whose objects created later are
+// covered, see grantCreators.
+func grantQueries(schemas []string, owner, creators string, version int) []string {
+	if len(schemas) == 0 {
+		schemas = []string{"public"}
 	}
+	grants := []string{
+		"GRANT ALL PRIVILEGES ON ALL TABLES IN SCHEMA %[1]s TO %[2]s",
+		"GRANT ALL PRIVILEGES ON ALL SEQUENCES IN SCHEMA %[1]s TO %[2]s",
+		"ALTER DEFAULT PRIVILEGES FOR ROLE %[3]s IN SCHEMA %[1]s GRANT ALL PRIVILEGES ON TABLES TO %[2]s",
+		"ALTER DEFAULT PRIVILEGES FOR ROLE %[3]s IN SCHEMA %[1]s GRANT ALL PRIVILEGES ON SEQUENCES TO %[2]s",
+	}
+	var queries []string
+	for _, schema := range schemas {
+		// As of PostgreSQL 15 PUBLIC no longer has CREATE on the public schema,
+		// which is instead owned by pg_database_owner. Grant it explicitly so the
+		// user can create objects regardless of how ownership is set up. Other
+		// schemas never granted anything to PUBLIC.
+		if version >= 150000 || schema != "public" {
+			queries = append(queries, fmt.Sprintf("GRANT ALL ON SCHEMA %s TO %s", quoteIdent(schema), owner))
+		}
+		for _, q := range grants {
+			queries = append(queries, fmt.Sprintf(q, quoteIdent(schema), owner, creators))
+		}
+	}
+	return queries
+}
 
+// alterDatabaseSettings applies opt.DatabaseSettings to dbName, in name order.
+func alterDatabaseSettings(dbName string, opt Options) error {
+	queries := settingsQueries(dbName, opt)
+	if len(queries) == 0 {
+		return nil
+	}
+	if _, err := execQuery("postgres", strings.Join(queries, "; "), opt); err != nil {
+		return err
+	}
 	if opt.Debug {
-		log.Printf("[%s]: drop db:%s", out, dbName)
+		log.Printf("successfully applied settings %v to db:%s", opt.DatabaseSettings, dbName)
 	}
-
 	return nil
 }
 
-// Import from a sql file, where file must be relative to the current
-// working directory. Exmaple, sql file can be of the format:
-// data/schema/schema.sql, /data/schema/schema.sql or ./data/schema/schema.sql
-func Import(dbName string, sqlFile string, opt Options) error {
-	if sqlFile == "" {
-		return errors.New("required option: sql file to import")
-	}
-
-	// terminate is called by drop.
+// listSettings are the settings of DatabaseSettings which take a list of
+// values, e.g. search_path = 'app', 'public'. Setting names are case
+// insensitive.
+var listSettings = map[string]bool{
+	"search_path":               true,
+	"temp_tablespaces":          true,
+	"datestyle":                 true,
+	"session_preload_libraries": true,
+	"local_preload_libraries":   true,
+}
 
-	if err := Drop(dbName, opt); err != nil {
-		return err
+// settingsQueries returns the statements applying opt.DatabaseSettings.
+func settingsQueries(dbName string, opt Options) []string {
+	settings := opt.DatabaseSettings
+	if _, ok := settings["search_path"]; !ok && len(opt.Schemas) > 0 {
+		settings = cloneMap(settings)
+		if settings == nil {
+			settings = make(map[string]string)
+		}
+		settings["search_path"] = strings.Join(append(append([]string(nil), opt.Schemas...), "public"), ",")
 	}
-	if err := Create(dbName, opt); err != nil {
-		return err
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var queries []string
+	for _, name := range names {
+		values := []string{quoteLiteral(settings[name])}
+		if listSettings[strings.ToLower(name)] {
+			values = values[:0]
+			for _, v := range strings.Split(settings[name], ",") {
+				values = append(values, quoteLiteral(strings.TrimSpace(v)))
+			}
+		}
+		queries = append(queries, fmt.Sprintf("ALTER DATABASE %s SET %s = %s",
+			dbName, name, strings.Join(values, ", ")))
 	}
+	return queries
+}
 
-	file := strings.TrimPrefix(sqlFile, ".")
-	file = strings.TrimPrefix(file, "/")
-	dir, _ := filepath.Split(file)
-	absDir, err := filepath.Abs(dir)
+// createRole creates role, without a password or login, unless it exists.
+func createRole(role string, opt Options) error {
+	q := fmt.Sprintf("SELECT EXISTS ( SELECT rolname FROM pg_catalog.pg_roles WHERE rolname = %s);", quoteLiteral(role))
+	out, err := queryScalar("postgres", q, opt)
 	if err != nil {
 		return err
 	}
-	opt.dockerVolume = fmt.Sprintf("%s:/%s", absDir, dir)
-
-	// As far as the container or psql is concerned, sqlFile is just a
-	// path to a file. The docker volume ensure the file makes
-	// it into the container.
-	cmd := psqlFile(dbName, sqlFile, opt)
-	out, err := run(cmd, opt)
-	if err != nil {
+	exists, err := parseBool(out, opt)
+	if err != nil || exists {
+		return err
+	}
+	out, err = execQuery("postgres", fmt.Sprintf("CREATE ROLE %s;", role), opt)
+	if err != nil && !isDuplicate(err) {
 		return err
 	}
-
 	if opt.Debug {
-		log.Printf("[%s]: successfully imported into db:%s from file:%s", out, dbName, sqlFile)
+		log.Printf("[%s]: successfully created role:%s", out, role)
 	}
-
 	return nil
 }
 
-// SchemaDump does a schema-only pg_dump, cleans out specific lines and
-// returns the output, optionally writes output to a file if not empty string.
-func SchemaDump(dbName string, outputFile string, opt Options) (string, error) {
+func Exists(dbName string, opt Options) (err error) {
+	defer trace("Exists", dbName, &opt)(&err)
+
 	if err := opt.isValid(dbName); err != nil {
-		return "", err
-	}
-	if opt.DBPort == 0 {
-		opt.DBPort = 5432
+		return err
 	}
 
-	cmd := fmt.Sprintf("PGPASSWORD=%s pg_dump -h %s -p %d -U %s %s --schema-only",
-		opt.DBPassword, opt.DBHost, opt.DBPort, opt.DBUser, dbName)
-
-	out, err := run(cmd, opt)
+	q := fmt.Sprintf("SELECT EXISTS ( SELECT datname FROM pg_database WHERE datname = '%s')", dbName)
+	out, err := queryScalar("postgres", q, opt.admin().reader())
+	if err != nil {
+		return err
+	}
+	exists, err := parseBool(out, opt)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if opt.Debug {
+			log.Printf("skipping creating db:%s exists", dbName)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%s: %w", dbName, ErrDBNotExist)
+}
+
+// GetOwner returns the role owning dbName, e.g. to check the result of
+// Create. It returns ErrDBNotExist if the database does not exist.
+func GetOwner(dbName string, opt Options) (_ string, err error) {
+	defer trace("GetOwner", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return "", err
+	}
+
+	q := fmt.Sprintf(`SELECT coalesce((SELECT r.rolname FROM pg_database d JOIN pg_roles r ON r.oid = d.datdba
+WHERE d.datname = %s), '');`, quoteLiteral(dbName))
+	out, err := queryScalar("postgres", q, opt.admin().reader())
+	if err != nil || opt.DryRun {
+		return "", err
+	}
+	if out == "" {
+		return "", fmt.Errorf("%s: %w", dbName, ErrDBNotExist)
+	}
+
+	return out, nil
+}
+
+// GetEncoding returns the encoding, e.g. UTF8, and the LC_COLLATE and
+// LC_CTYPE locales of dbName, e.g. to check the result of Create. It returns
+// ErrDBNotExist if the database does not exist.
+func GetEncoding(dbName string, opt Options) (encoding string, collate string, ctype string, err error) {
+	defer trace("GetEncoding", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return "", "", "", err
+	}
+
+	q := fmt.Sprintf(`SELECT coalesce((SELECT concat_ws('|', pg_encoding_to_char(encoding), datcollate, datctype)
+FROM pg_database WHERE datname = %s), '');`, quoteLiteral(dbName))
+	out, err := queryScalar("postgres", q, opt.admin().reader())
+	if err != nil || opt.DryRun {
+		return "", "", "", err
+	}
+	if out == "" {
+		return "", "", "", fmt.Errorf("%s: %w", dbName, ErrDBNotExist)
+	}
+	fields := strings.Split(out, "|")
+	if len(fields) != 3 {
+		return "", "", "", fmt.Errorf("postdock: unexpected encoding of db %s: %q", dbName, out)
+	}
+
+	return fields[0], fields[1], fields[2], nil
+}
+
+func Terminate(dbName string, opt Options) (err error) {
+	defer trace("Terminate", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return err
+	}
+
+	q := fmt.Sprintf("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = '%s' AND pid <> pg_backend_pid();", dbName)
+	out, err := execQuery("postgres", q, opt.admin())
+	if err != nil {
+		if isPermissionError(err) {
+			return fmt.Errorf("%s: %w: %v", dbName, ErrTerminatePermission, err)
+		}
+		return err
+	}
+
+	if opt.Debug {
+		log.Printf("[%s]: terminate db:%s errors:%v", out, dbName, err)
+	}
+
+	return nil
+}
+
+// TerminateByUser terminates all sessions of the given role, on any
+// database, and returns how many were terminated.
+func TerminateByUser(user string, opt Options) (_ int, err error) {
+	defer trace("TerminateByUser", "postgres", &opt)(&err)
+
+	if user == "" {
+		return 0, errors.New("postdock: required option: user")
+	}
+	return terminateWhere("usename = "+quoteLiteral(user), opt)
+}
+
+// TerminateByApp terminates all sessions with the given application_name, on
+// any database, and returns how many were terminated.
+func TerminateByApp(appName string, opt Options) (_ int, err error) {
+	defer trace("TerminateByApp", "postgres", &opt)(&err)
+
+	if appName == "" {
+		return 0, errors.New("postdock: required option: application name")
+	}
+	return terminateWhere("application_name = "+quoteLiteral(appName), opt)
+}
+
+// terminateWhere terminates the sessions in pg_stat_activity matching
+// predicate, except our own, and returns how many were terminated.
+func terminateWhere(predicate string, opt Options) (int, error) {
+	if err := opt.isValid("postgres"); err != nil {
+		return 0, err
+	}
+
+	q := fmt.Sprintf("SELECT count(*) FILTER (WHERE pg_terminate_backend(pid)) FROM pg_stat_activity WHERE %s AND pid <> pg_backend_pid();", predicate)
+	out, err := queryScalar("postgres", q, opt.admin())
+	if err != nil {
+		if isPermissionError(err) {
+			return 0, fmt.Errorf("%w: %v", ErrTerminatePermission, err)
+		}
+		return 0, err
+	}
+	if opt.DryRun {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(out)
+	if err != nil {
+		return 0, err
+	}
+	if opt.Debug {
+		log.Printf("terminated %d sessions where %s", n, predicate)
+	}
+
+	return n, nil
+}
+
+func Drop(dbName string, opt Options) (err error) {
+	defer trace("Drop", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return err
+	}
+	// Skip terminating and dropping a missing database, but do not mistake a
+	// connection failure for it.
+	err = Exists(dbName, opt)
+	switch {
+	case opt.DryRun:
+	case errors.Is(err, ErrDBNotExist):
+		if opt.Debug {
+			log.Printf("skipping drop of missing db:%s", dbName)
+		}
+		return nil
+	case err != nil:
+		return err
+	}
+	if !opt.SkipTerminate {
+		err := Terminate(dbName, opt)
+		switch {
+		case errors.Is(err, ErrTerminatePermission):
+			// Still attempt the drop, it only fails if the database is in use.
+			if opt.Debug {
+				log.Printf("continuing to drop db:%s: %v", dbName, err)
+			}
+		case err != nil:
+			return err
+		}
+	}
+
+	q := fmt.Sprintf("DROP DATABASE IF EXISTS %s;", dbName)
+	out, err := execQuery("postgres", q, opt.admin())
+	if err != nil {
+		return err
+	}
+
+	if opt.Debug {
+		log.Printf("[%s]: drop db:%s", out, dbName)
+	}
+
+	return nil
+}
+
+// ServerVersion returns the server version as an integer, as reported by
+// server_version_num, e.g. 110008 for 11.8 or 150002 for 15.2.
+func ServerVersion(opt Options) (_ int, err error) {
+	defer trace("ServerVersion", "postgres", &opt)(&err)
+
+	if err := opt.isValid("postgres"); err != nil {
+		return 0, err
+	}
+
+	out, err := queryScalar("postgres", "SHOW server_version_num;", opt.reader())
+	if err != nil {
+		return 0, err
+	}
+	if opt.DryRun {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(out)
+	if err != nil {
+		return 0, fmt.Errorf("postdock: unexpected server version %q: %w", out, err)
+	}
+
+	return version, nil
+}
+
+// Authenticate checks that DBUser can log in with DBPassword, by running a
+// trivial query against the maintenance database. Use it as a preflight
+// before other operations, whose failures are less obvious to diagnose.
+func Authenticate(opt Options) (err error) {
+	defer trace("Authenticate", "postgres", &opt)(&err)
+
+	if err := opt.isValid("postgres"); err != nil {
+		return err
+	}
+
+	_, err = queryScalar("postgres", "SELECT 1;", opt.reader())
+	if err == nil {
+		return nil
+	}
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "authentication failed"),
+		strings.Contains(msg, "no password supplied"),
+		strings.Contains(msg, "no pg_hba.conf entry"):
+		return fmt.Errorf("%w: user %s: %v", ErrAuthFailed, opt.DBUser, err)
+	case strings.Contains(msg, "connection refused"),
+		strings.Contains(msg, "could not connect to server"),
+		strings.Contains(msg, "could not translate host name"),
+		strings.Contains(msg, "no such host"),
+		strings.Contains(msg, "timeout expired"):
+		return fmt.Errorf("%w: %s:%d: %v", ErrConnectionRefused, opt.DBHost, opt.normalize().DBPort, err)
+	}
+	return err
+}
+
+// QueryScalar runs a query against dbName which must return exactly one row
+// with a single column, and returns that value with surrounding whitespace
+// trimmed. It is an error if the query returns no or multiple rows.
+func QueryScalar(dbName string, query string, opt Options) (_ string, err error) {
+	defer trace("QueryScalar", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return "", err
+	}
+
+	return queryScalar(dbName, query, opt.reader())
+}
+
+// queryScalar implements QueryScalar without validating opt.
+func queryScalar(dbName string, query string, o Options) (string, error) {
+	if o.SQLDriver != "" {
+		return withBusyRetries(o, func() (string, error) {
+			return sqlQueryScalar(dbName, query, o)
+		})
+	}
+	// Unaligned output with the header and footer, e.g. "exists\nt\n(1 row)". The
+	// footer is what tells an empty value apart from no rows at all.
+	cmd := psqlCmd(dbName, o, "-A", "-c", quote(query))
+	out, err := run(cmd, o)
 	if err != nil {
 		return "", err
 	}
+	if o.DryRun {
+		return "", nil
+	}
+
+	lines := strings.Split(out, "\n")
+	var n int
+	if _, err := fmt.Sscanf(lines[len(lines)-1], "(%d", &n); err != nil || len(lines) < 2 {
+		return "", fmt.Errorf("postdock: unexpected query output: %q", out)
+	}
+	if n != 1 {
+		return "", fmt.Errorf("postdock: query returned %d rows, expected 1", n)
+	}
+	if strings.Contains(lines[0], "|") {
+		return "", fmt.Errorf("postdock: query returned multiple columns %q, expected 1", lines[0])
+	}
+
+	return strings.TrimSpace(strings.Join(lines[1:len(lines)-1], "\n")), nil
+}
+
+// CountRows returns the number of rows in table, which may be schema
+// qualified, e.g. users or audit.events.
+func CountRows(dbName string, table string, opt Options) (_ int64, err error) {
+	defer trace("CountRows", dbName, &opt)(&err)
+
+	return countRows(dbName, table, "", opt)
+}
 
+// CountRowsWhere is like CountRows but only counts the rows matching the where
+// predicate, e.g. "deleted_at IS NULL". The predicate is used as is, see the
+// package documentation about sql injection.
+func CountRowsWhere(dbName string, table string, where string, opt Options) (_ int64, err error) {
+	defer trace("CountRowsWhere", dbName, &opt)(&err)
+
+	return countRows(dbName, table, where, opt)
+}
+
+// countRows implements CountRows and CountRowsWhere.
+func countRows(dbName string, table string, where string, opt Options) (int64, error) {
+	if err := opt.isValid(dbName); err != nil {
+		return 0, err
+	}
+	if table == "" {
+		return 0, errors.New("postdock: required option: table name")
+	}
+
+	q := fmt.Sprintf("SELECT count(*) FROM %s", quoteIdent(table))
+	if where != "" {
+		q += " WHERE " + where
+	}
+	out, err := queryScalar(dbName, q, opt.reader())
+	if err != nil {
+		if strings.Contains(err.Error(), "does not exist") && strings.Contains(err.Error(), "relation") {
+			return 0, fmt.Errorf("%s: %w", table, ErrTableNotExist)
+		}
+		return 0, err
+	}
+	if opt.DryRun {
+		return 0, nil
+	}
+
+	return strconv.ParseInt(out, 10, 64)
+}
+
+// ClientVersion returns the version of pg_dump in DockerImage, or the local
+// pg_dump when running inside a container, in the same format as ServerVersion.
+func ClientVersion(opt Options) (_ int, err error) {
+	defer trace("ClientVersion", "", &opt)(&err)
+
+	if err := opt.isValid("postgres"); err != nil {
+		return 0, err
+	}
+
+	out, err := run(quote(opt.normalize().PgDumpPath)+" --version", opt)
+	if err != nil {
+		return 0, err
+	}
+	if opt.DryRun {
+		return 0, nil
+	}
+
+	return parseVersion(out)
+}
+
+// clientVersion matches the output of pg_dump --version, e.g.
+// "pg_dump (PostgreSQL) 11.8" or "pg_dump (PostgreSQL) 16.1 (Debian 16.1-1)".
+var clientVersion = regexp.MustCompile(`\(PostgreSQL\) (\d+)(?:\.(\d+))?(?:\.(\d+))?`)
+
+// ValidateImage checks that DockerImage, or the local PATH when commands run
+// directly, contains psql, pg_dump and pg_restore, and returns ErrMissingTool
+// naming those which are missing. It is a cheap preflight for images which
+// would otherwise fail with "psql: not found" deep inside an operation.
+func ValidateImage(opt Options) (err error) {
+	defer trace("ValidateImage", "", &opt)(&err)
+
+	if err := opt.isValid("postgres"); err != nil {
+		return err
+	}
+
+	o := opt.normalize()
+	var checks []string
+	for _, tool := range []string{o.PsqlPath, o.PgDumpPath, o.PgRestorePath} {
+		checks = append(checks, fmt.Sprintf("command -v %s >/dev/null || echo %s",
+			quote(tool), quote("missing:"+tool)))
+	}
+	out, err := run(strings.Join(checks, "; "), opt)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, line := range strings.Split(out, "\n") {
+		if tool := strings.TrimPrefix(line, "missing:"); tool != line {
+			missing = append(missing, tool)
+		}
+	}
+	if len(missing) > 0 {
+		where := "image " + opt.DockerImage
+		if opt.local() {
+			where = "PATH"
+		}
+		return fmt.Errorf("%w: %s not in %s", ErrMissingTool, strings.Join(missing, ", "), where)
+	}
+
+	return nil
+}
+
+// parseVersion converts a version string to the server_version_num format,
+// e.g. 9.6.3 to 90603 and 11.8 to 110008.
+func parseVersion(s string) (int, error) {
+	m := clientVersion.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("postdock: unexpected client version %q", s)
+	}
+	var parts [3]int
+	for i := range parts {
+		parts[i], _ = strconv.Atoi(m[i+1])
+	}
+	// Since PostgreSQL 10 the version has two parts, major and minor.
+	if parts[0] >= 10 {
+		return parts[0]*10000 + parts[1], nil
+	}
+	return parts[0]*10000 + parts[1]*100 + parts[2], nil
+}
+
+// versionMismatchError turns pg_dump's "server version mismatch" error into an
+// actionable ErrClientTooOld, any other error is returned as is.
+func versionMismatchError(err error, o Options) error {
+	if !strings.Contains(err.Error(), "server version mismatch") {
+		return err
+	}
+	server, serr := ServerVersion(o)
+	client, cerr := ClientVersion(o)
+	if serr != nil || cerr != nil {
+		return err
+	}
+	return fmt.Errorf("%w: pg_dump %d is older than server %d, use a newer image such as postgres:%d-alpine: %v",
+		ErrClientTooOld, client/10000, server/10000, server/10000, err)
+}
+
+// Result is the outcome of running sql with psql.
+type Result struct {
+	// Output is psql's combined output. Only its beginning and end are kept
+	// for Import and ApplySQL, see Options.MaxErrorOutput, but RowsAffected
+	// still counts all of it.
+	Output string
+	// RowsAffected is the total of the row counts reported by psql's command
+	// tags, e.g. INSERT 0 5, UPDATE 3, DELETE 42 or COPY 1500. Zero if none
+	// were reported.
+	RowsAffected int64
+}
+
+// commandTag matches psql command tags which carry a row count. INSERT
+// reports an oid before the count.
+var commandTag = regexp.MustCompile(`(?m)^(?:INSERT \d+|UPDATE|DELETE|COPY|MERGE|SELECT|MOVE|FETCH) (\d+)$`)
+
+// truncatedRows matches the marker of an output truncated by outputBuffer,
+// which counted the rows of all command tags.
+var truncatedRows = regexp.MustCompile(`(?m)^\[truncated \d+ bytes, (\d+) rows affected in total\]$`)
+
+// newResult parses the command tags in psql output into a Result.
+func newResult(out string) Result {
+	r := Result{Output: out}
+	if m := truncatedRows.FindStringSubmatch(out); m != nil {
+		r.RowsAffected, _ = strconv.ParseInt(m[1], 10, 64)
+		return r
+	}
+	for _, m := range commandTag.FindAllStringSubmatch(out, -1) {
+		n, _ := strconv.ParseInt(m[1], 10, 64)
+		r.RowsAffected += n
+	}
+	return r
+}
+
+// Exec runs queries against dbName in a single psql session and returns the
+// combined output. Since it is one session, state such as SET ROLE or the
+// search_path carries over from one query to the next. The queries are sent
+// as is, see the package documentation about sql injection.
+func Exec(dbName string, queries []string, opt Options) (_ Result, err error) {
+	defer trace("Exec", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return Result{}, err
+	}
+	if len(queries) == 0 {
+		return Result{}, errors.New("postdock: required option: at least one query")
+	}
+
+	var args []string
+	if opt.SingleTransaction {
+		args = append(args, "--single-transaction")
+	}
+	for _, q := range queries {
+		args = append(args, "-c", quote(q))
+	}
+	cmd := psqlCmd(dbName, opt, args...)
+	out, err := run(cmd, opt)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if opt.Debug {
+		log.Printf("[%s]: executed %d queries on db:%s", out, len(queries), dbName)
+	}
+
+	return newResult(out), nil
+}
+
+// ApplySQL runs sql, e.g. generated or embedded into the binary, against the
+// existing database dbName. Unlike Import, nothing is dropped or recreated.
+// The sql is piped to psql's stdin, so no volume mount is needed and it works
+// with remote docker daemons too. Options.SingleTransaction applies it in one
+// transaction.
+func ApplySQL(dbName string, sql string, opt Options) (_ Result, err error) {
+	defer trace("ApplySQL", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return Result{}, err
+	}
+
+	if opt.NoMetaCommands {
+		// With -c psql sends the string to the server as is.
+		out, err := run(psqlCmd(dbName, opt, "-c", quote(sql)), opt)
+		if err != nil {
+			return Result{}, err
+		}
+		return newResult(out), nil
+	}
+	return applyInput(dbName, strings.NewReader(sql), opt)
+}
+
+// applyInput pipes the sql from r to psql against dbName.
+func applyInput(dbName string, r io.Reader, opt Options) (Result, error) {
+	var args []string
+	if opt.SingleTransaction {
+		args = append(args, "--single-transaction")
+	}
+	args = append(args, "--file=-")
+	out, err := runInput(psqlCmd(dbName, opt, args...), r, opt.bounded())
+	if err != nil {
+		return Result{}, parseImportError(err)
+	}
+
+	if opt.Debug {
+		log.Printf("[%s]: successfully applied sql to db:%s", out, dbName)
+	}
+
+	return newResult(out), nil
+}
+
+// Import from a sql file, where file must be relative to the current
+// working directory. Exmaple, sql file can be of the format:
+// data/schema/schema.sql, /data/schema/schema.sql or ./data/schema/schema.sql
+//
+// Import drops and re-creates dbName first, use ImportWithOptions to keep it.
+func Import(dbName string, sqlFile string, opt Options) error {
+	_, err := ImportWithResult(dbName, sqlFile, opt)
+	return err
+}
+
+// ImportWithResult is like Import but also returns psql's output and the
+// number of rows affected, e.g. by COPY or INSERT statements in sqlFile.
+func ImportWithResult(dbName string, sqlFile string, opt Options) (Result, error) {
+	return ImportWithOptions(dbName, sqlFile, ImportOptions{DropFirst: true, CreateFirst: true}, opt)
+}
+
+// ImportOptions configures the steps ImportWithOptions takes before applying
+// the sql file. The zero value takes none, so the database must exist.
+type ImportOptions struct {
+	// TerminateFirst terminates the sessions of the database, e.g. to import
+	// into it without dropping it. DropFirst does so as well, unless
+	// Options.SkipTerminate is set.
+	TerminateFirst bool
+	// DropFirst drops the database, which requires CreateFirst.
+	DropFirst bool
+	// CreateFirst creates the roles and the database if missing, and grants
+	// the privileges like Create, e.g. to import into a new database while
+	// keeping an existing one.
+	CreateFirst bool
+}
+
+// ImportWithOptions is like ImportWithResult, but only drops and creates
+// dbName first as set in iopt. Import and ImportWithResult do both.
+func ImportWithOptions(dbName string, sqlFile string, iopt ImportOptions, opt Options) (_ Result, err error) {
+	defer trace("Import", dbName, &opt)(&err)
+
+	if sqlFile == "" {
+		return Result{}, errors.New("required option: sql file to import")
+	}
+	if iopt.DropFirst && !iopt.CreateFirst {
+		return Result{}, errors.New("postdock: dropping the database first requires creating it as well")
+	}
+	if err := opt.isValid(dbName); err != nil {
+		return Result{}, err
+	}
+
+	if iopt.TerminateFirst && !iopt.DropFirst {
+		if err := Terminate(dbName, opt); err != nil {
+			return Result{}, err
+		}
+	}
+	if iopt.DropFirst {
+		// Terminates the sessions as well.
+		if err := Drop(dbName, opt); err != nil {
+			return Result{}, err
+		}
+	}
+	if iopt.CreateFirst {
+		if err := Create(dbName, opt); err != nil {
+			return Result{}, err
+		}
+	}
+
+	file := strings.TrimPrefix(sqlFile, ".")
+	file = strings.TrimPrefix(file, "/")
+	if importOverStdin(opt) {
+		return importStdin(dbName, file, opt)
+	}
+	cmdFile, vol, err := mountFile(file, opt)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// As far as the container or psql is concerned, sqlFile is just a
+	// path to a file. The docker volume ensure the file makes
+	// it into the container.
+	cmd := psqlFile(dbName, cmdFile, opt)
+	out, err := run(cmd, opt.bounded(), vol)
+	if err != nil {
+		return Result{}, parseImportError(err)
+	}
+
+	if opt.Debug {
+		log.Printf("[%s]: successfully imported into db:%s from file:%s", out, dbName, sqlFile)
+	}
+
+	return newResult(out), nil
+}
+
+// importOverStdin reports whether Import streams the file over stdin, see
+// Options.ImportOverStdin.
+func importOverStdin(opt Options) bool {
+	if opt.ImportOverStdin {
+		return true
+	}
+	if opt.local() || opt.DryRun || opt.CopyFiles {
+		return false
+	}
+	host, remote := remoteDocker(opt)
+	if remote && opt.Debug {
+		log.Printf("importing over stdin, docker host %s is remote", host)
+	}
+	return remote
+}
+
+// importStdin applies file, relative to the current working directory, over
+// stdin.
+func importStdin(dbName string, file string, opt Options) (Result, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return Result{}, err
+	}
+	defer f.Close()
+
+	res, err := applyInput(dbName, f, opt)
+	if err != nil {
+		// psql only knows it read from stdin.
+		var ierr *ImportError
+		if errors.As(err, &ierr) {
+			ierr.File = file
+		}
+		return Result{}, err
+	}
+	return res, nil
+}
+
+// workspaceMount is where mountDir mounts directories which cannot be mounted
+// at their relative path, e.g. absolute ones, in the container.
+const workspaceMount = "/.postdock"
+
+// mountDir returns the path under which commands find the host directory
+// dir, and the docker volume making it available there. A directory below the
+// current working directory keeps its relative path, see volume. Any other,
+// such as an absolute path, the working directory itself or one outside of
+// it, is mounted below workspaceMount at its absolute path, so it neither
+// shadows directories of the image nor depends on Workdir.
+func mountDir(dir string, o Options) (string, string, error) {
+	dir = filepath.Clean(dir)
+	if o.local() {
+		return dir, "", nil
+	}
+	parent := ".." + string(filepath.Separator)
+	if !filepath.IsAbs(dir) && dir != "." && dir != ".." && !strings.HasPrefix(dir, parent) {
+		vol, err := volume(dir)
+		return filepath.ToSlash(dir), vol, err
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", "", err
+	}
+	// Drop the drive letter, if any, for a valid path in the container.
+	target := path.Join(workspaceMount, filepath.ToSlash(strings.TrimPrefix(absDir, filepath.VolumeName(absDir))))
+	return target, absDir + ":" + target, nil
+}
+
+// mountFile is like mountDir for a file, or a directory which a command
+// creates, by mounting its parent directory. It returns the path of file.
+func mountFile(file string, o Options) (string, string, error) {
+	dir, vol, err := mountDir(filepath.Dir(file), o)
+	if err != nil {
+		return "", "", err
+	}
+	if o.local() {
+		return filepath.Join(dir, filepath.Base(file)), "", nil
+	}
+	return path.Join(dir, filepath.Base(file)), vol, nil
+}
+
+// volume returns the docker volume which makes dir, relative to the current
+// working directory, available at the same relative path inside the container.
+// Like those of mountDir, the volume is not quoted, runInput quotes it.
+func volume(dir string) (string, error) {
+	dir = strings.TrimPrefix(dir, ".")
+	dir = strings.TrimPrefix(dir, "/")
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:/%s", absDir, dir), nil
+}
+
+// SchemaDump does a schema-only pg_dump, cleans out specific lines, see
+// Options.DumpFilter, and returns the output, optionally writes output to a
+// file if not empty string.
+func SchemaDump(dbName string, outputFile string, opt Options) (string, error) {
+	res, err := SchemaDumpWithResult(dbName, outputFile, opt)
+	return res.Content, err
+}
+
+// DumpResult describes the output of SchemaDumpWithResult.
+type DumpResult struct {
+	// Content is the cleaned up dump.
+	Content string
+	// Bytes and Lines are the size of Content.
+	Bytes int
+	Lines int
+	// Changed reports whether the output file did not exist or had a
+	// different content. It is always false without an output file.
+	Changed bool
+}
+
+// SchemaDumpWithResult is like SchemaDump but also describes the dump and
+// whether it changed the output file, e.g. for a pre-commit hook detecting an
+// out of date schema file. An unchanged output file is not rewritten.
+func SchemaDumpWithResult(dbName string, outputFile string, opt Options) (_ DumpResult, err error) {
+	defer trace("SchemaDump", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return DumpResult{}, err
+	}
+	cmd := pgDumpCmd(dbName, opt, "--schema-only")
+
+	out, err := run(cmd, opt)
+	if err != nil {
+		return DumpResult{}, versionMismatchError(err, opt)
+	}
+
+	keep := opt.DumpFilter
+	if keep == nil {
+		keep = DefaultDumpFilter
+	}
 	p := script.Echo(out).
-		Reject(`ALTER DEFAULT PRIVILEGES`).
-		Reject(`OWNER TO`).
-		RejectRegexp(regexp.MustCompile(`^--`)).
-		RejectRegexp(regexp.MustCompile(`^REVOKE`)).
-		RejectRegexp(regexp.MustCompile(`^COMMENT ON`)).
-		RejectRegexp(regexp.MustCompile(`^SET`)).
-		RejectRegexp(regexp.MustCompile(`^GRANT`)).Exec("cat -s")
+		EachLine(dumpHeaderAndSettings(opt)).
+		EachLine(func(line string, out *strings.Builder) {
+			if keep(line) {
+				out.WriteString(line)
+				out.WriteByte('\n')
+			}
+		})
+
+	n := p.ExitStatus()
+	if n > 0 {
+		p.SetError(nil)
+		out, _ := p.String()
+		return DumpResult{}, rawError(out, opt)
+	}
+
+	dump, err := p.String()
+	if err != nil {
+		return DumpResult{}, err
+	}
+	dump = normalizeDump(dump)
+	res := DumpResult{
+		Content: dump,
+		Bytes:   len(dump),
+		Lines:   strings.Count(dump, "\n"),
+	}
+	if dump != "" && !strings.HasSuffix(dump, "\n") {
+		res.Lines++
+	}
+
+	// Do not clobber an existing file with an empty dry-run dump.
+	if outputFile != "" && !opt.DryRun {
+		old, err := ioutil.ReadFile(outputFile)
+		if err != nil && !os.IsNotExist(err) {
+			return DumpResult{}, err
+		}
+		res.Changed = err != nil || string(old) != dump
+		if res.Changed {
+			if err := writeFileAtomic(outputFile, dump); err != nil {
+				return DumpResult{}, err
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// normalizeDump makes a dump stable across platforms and reruns: LF line
+// endings, no leading or repeated blank lines, and exactly one trailing
+// newline, unless the dump is empty.
+func normalizeDump(dump string) string {
+	dump = strings.ReplaceAll(dump, "\r\n", "\n")
+	var b strings.Builder
+	blank := true
+	for _, line := range strings.Split(dump, "\n") {
+		if strings.TrimSpace(line) == "" {
+			blank = true
+			continue
+		}
+		if blank && b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		blank = false
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// trace notifies o.Hook, if any, that op started and returns a function to
+// report when it finished. Intended to be deferred with a named error:
+//
+//	defer trace("Create", dbName, &opt)(&err)
+//
+// It sets the deadline of the operation according to o.Timeout, unless o is
+// passed on by an outer operation with a deadline already. It also attributes
+// a timeout to the innermost operation, see TimeoutError.
+func trace(op, dbName string, o *Options) func(*error) {
+	if o.Timeout > 0 && o.deadline.IsZero() {
+		o.deadline = time.Now().Add(o.Timeout)
+	}
+	o.op, o.dbName = op, dbName
+	hook, metrics := o.Hook, o.Metrics
+	if hook != nil {
+		hook.OnStart(op, dbName)
+	}
+	start := time.Now()
+	return func(err *error) {
+		dur := time.Since(start)
+		var te *TimeoutError
+		if *err != nil && errors.Is(*err, context.DeadlineExceeded) && !errors.As(*err, &te) {
+			*err = &TimeoutError{Op: op, DBName: dbName, Elapsed: dur, err: *err}
+		}
+		metrics.addOp(op, dur)
+		if hook != nil {
+			hook.OnFinish(op, dbName, dur, *err)
+		}
+	}
+}
+
+// TimeoutError is returned when an operation was killed because of
+// Options.Timeout. It names the operation and unwraps to
+// context.DeadlineExceeded.
+type TimeoutError struct {
+	Op      string
+	DBName  string
+	Elapsed time.Duration
+
+	err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("postdock: %s of db %s timed out after %s: %v",
+		e.Op, e.DBName, e.Elapsed.Round(time.Millisecond), e.err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.err
+}
+
+// parseBool parses the boolean output of a psql query. In dry-run mode
+// nothing is executed, so the result is always false.
+func parseBool(out string, o Options) (bool, error) {
+	if o.DryRun {
+		return false, nil
+	}
+	return strconv.ParseBool(out)
+}
+
+// redact replaces passwords in s, suitable for logging commands. Only a
+// password set with PGPASSWORD= or given to a PASSWORD clause is replaced, so
+// a password which is also e.g. the user name, like postgres, does not hide
+// the rest of the command. Quotes and their escapes around the password, by
+// SQL or by one or two levels of sh quoting, are kept as is.
+func redact(s string, o Options) string {
+	secrets := append([]string(nil), o.secrets...)
+	secrets = append(secrets, o.DBPassword, o.AdminPassword)
+	if o.RegistryAuth != nil {
+		secrets = append(secrets, o.RegistryAuth.Password)
+	}
+	shellEscape := strings.NewReplacer("'", `'"'"'`)
+	var variants []string
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		sql := strings.ReplaceAll(secret, "'", "''")
+		for _, v := range []string{secret, sql} {
+			once := shellEscape.Replace(v)
+			for _, v := range []string{v, once, shellEscape.Replace(once)} {
+				if strings.Contains(s, v) {
+					variants = append(variants, regexp.QuoteMeta(v))
+				}
+			}
+		}
+	}
+	if len(variants) == 0 {
+		return s
+	}
+	// Longest first, so a password is not replaced only in part.
+	sort.Slice(variants, func(i, j int) bool { return len(variants[i]) > len(variants[j]) })
+	re := regexp.MustCompile(`(PGPASSWORD=|(?i:\bpassword)\s+)(['"]*)(?:` + strings.Join(variants, "|") + `)`)
+	return re.ReplaceAllString(s, "${1}${2}********")
+}
+
+// DefaultDumpFilter is the filter SchemaDump uses unless Options.DumpFilter
+// is set. It drops GRANT, REVOKE, ALTER DEFAULT PRIVILEGES, OWNER TO and
+// COMMENT ON statements, which depend on the roles of a server rather than
+// on the schema.
+func DefaultDumpFilter(line string) bool {
+	return !strings.Contains(line, "ALTER DEFAULT PRIVILEGES") &&
+		!strings.Contains(line, "OWNER TO") &&
+		!strings.HasPrefix(line, "REVOKE") &&
+		!strings.HasPrefix(line, "COMMENT ON") &&
+		!strings.HasPrefix(line, "GRANT")
+}
+
+// dumpHeaderAndSettings returns a script.EachLine filter which drops comments
+// and SET statements from a pg_dump, except for those to keep according to
+// o.KeepDumpHeader and o.KeepDumpSettings.
+func dumpHeaderAndSettings(o Options) func(string, *strings.Builder) {
+	// The header is the run of comments and blank lines at the top.
+	header := true
+	return func(line string, out *strings.Builder) {
+		if header && line != "" && !strings.HasPrefix(line, "--") {
+			header = false
+		}
+		switch {
+		case strings.HasPrefix(line, "--"):
+			if !header || !o.KeepDumpHeader {
+				return
+			}
+		case strings.HasPrefix(line, "SET"):
+			if !keepSetting(line, o.KeepDumpSettings) {
+				return
+			}
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+}
+
+// keepSetting reports whether a SET statement, e.g. "SET client_encoding =
+// 'UTF8';", is for one of the settings to keep.
+func keepSetting(line string, keep []string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return false
+	}
+	for _, k := range keep {
+		if k == "*" || k == fields[1] {
+			return true
+		}
+	}
+	return false
+}
 
-	n := p.ExitStatus()
-	if n > 0 {
-		p.SetError(nil)
-		out, _ := p.String()
-		return "", fmt.Errorf("raw error: %s", out)
+// writeFileAtomic writes data to a temporary file next to name and renames it
+// into place, so a failure never leaves name truncated or partially written.
+// An existing file keeps its permissions, a new file gets 0644.
+func writeFileAtomic(name string, data string) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(name); err == nil {
+		mode = fi.Mode().Perm()
 	}
 
-	dump, err := p.String()
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
 	if err != nil {
-		return "", err
+		return err
 	}
+	// Nothing to remove once renamed.
+	defer os.Remove(f.Name())
 
-	if outputFile != "" {
-		f, err := os.OpenFile(outputFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-		if err != nil {
-			return "", err
-		}
-		if _, err := f.WriteString(dump); err != nil {
-			return "", err
-		}
+	if _, err := f.WriteString(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), mode); err != nil {
+		return err
 	}
+	return os.Rename(f.Name(), name)
+}
 
-	return dump, nil
+// isSocket reports whether host is a unix socket directory, such as
+// /var/run/postgresql, rather than a TCP host. psql and pg_dump accept
+// both with -h.
+func isSocket(host string) bool {
+	return strings.HasPrefix(host, "/")
 }
 
-func inDocker() bool {
-	if _, err := os.Stat("/.dockerenv"); err == nil {
+// UsesDocker reports whether commands run in a new container of
+// opt.DockerImage, or directly because the process is running inside a
+// container itself and the client tools are expected to be available. The
+// detection may be overridden with opt.ForceLocal or opt.ForceDocker.
+func UsesDocker(opt Options) bool {
+	return !opt.local()
+}
+
+// local reports whether commands run directly rather than in a container.
+func (o Options) local() bool {
+	switch {
+	case o.ForceLocal:
 		return true
+	case o.ForceDocker:
+		return false
 	}
-	return false
+	return inDocker()
+}
+
+var (
+	inDockerOnce sync.Once
+	inDockerRes  bool
+)
+
+// inDocker reports whether the process is running inside a container. Not
+// every runtime creates /.dockerenv, e.g. podman creates /run/.containerenv
+// and on kubernetes neither exists, so the cgroups of init are checked too.
+func inDocker() bool {
+	inDockerOnce.Do(func() {
+		for _, f := range []string{"/.dockerenv", "/run/.containerenv"} {
+			if _, err := os.Stat(f); err == nil {
+				inDockerRes = true
+				return
+			}
+		}
+		b, err := ioutil.ReadFile("/proc/1/cgroup")
+		if err != nil {
+			return
+		}
+		for _, s := range []string{"docker", "kubepods", "containerd", "libpod"} {
+			if strings.Contains(string(b), s) {
+				inDockerRes = true
+				return
+			}
+		}
+	})
+	return inDockerRes
 }
 
 // psql is a helper function that takes a sql query and builds a psql
 // command against the given database. It can be passed directly to run.
+// The output is unaligned and tuples only, e.g. "t" for a boolean.
 func psql(dbName string, query string, o Options) string {
-	if o.DBPort == 0 {
-		o.DBPort = 5432
-	}
-	return fmt.Sprintf("PGPASSWORD=%s psql -h %s -d %s -U %s -p %d -v ON_ERROR_STOP=1 -t -c %q",
-		o.DBPassword, o.DBHost, dbName, o.DBUser, o.DBPort, query)
+	return psqlCmd(dbName, o, "-A", "-t", "-c", quote(query))
 }
 
 func psqlFile(dbName string, fileName string, o Options) string {
-	if o.DBPort == 0 {
-		o.DBPort = 5432
+	return psqlCmd(dbName, o, "--file="+quote(fileName))
+}
+
+// psqlCmd builds a psql command against the given database with the
+// connection flags from o. args are appended as is, so any user input
+// must already be quoted. The psqlrc of the user is never read, since
+// settings like \timing or \pset would end up in the parsed output.
+func psqlCmd(dbName string, o Options, args ...string) string {
+	o = o.normalize()
+	switch {
+	case len(o.IgnoreErrors) > 0:
+		// Verbose errors include the SQLSTATE, for checkIgnoredErrors.
+		args = append([]string{"-v VERBOSITY=verbose"}, args...)
+	case !o.ContinueOnError:
+		args = append([]string{"-v ON_ERROR_STOP=1"}, args...)
+	}
+	// Sorted, so the command is the same on every run.
+	names := make([]string, 0, len(o.Variables))
+	for name := range o.Variables {
+		names = append(names, name)
 	}
-	return fmt.Sprintf("PGPASSWORD=%s psql -h %s -d %s -U %s -p %d -v ON_ERROR_STOP=1 --file=%s",
-		o.DBPassword, o.DBHost, dbName, o.DBUser, o.DBPort, fileName)
+	sort.Strings(names)
+	vars := make([]string, 0, len(names))
+	for _, name := range names {
+		vars = append(vars, "-v "+quote(name+"="+o.Variables[name]))
+	}
+	args = append(vars, args...)
+	// Validated by isValid.
+	extra, _ := extraArgs(o.PsqlExtraArgs)
+	args = append(extra, args...)
+	args = append([]string{"--no-psqlrc"}, args...)
+	return fmt.Sprintf("%s %s -h %s -d %s -U %s -p %d %s",
+		pgEnv(o), quote(o.PsqlPath), o.DBHost, dbName, o.DBUser, o.DBPort, strings.Join(args, " "))
 }
 
-func run(cmd string, o Options) (string, error) {
-	// Inside a docker container we expect the command name to be available.
-	if inDocker() {
-		p := script.Exec(cmd)
-		n := p.ExitStatus()
-		if n > 0 {
-			p.SetError(nil)
-			out, _ := p.String()
-			return "", fmt.Errorf("raw error: %s", out)
-		}
+// pgDumpCmd builds a pg_dump command for the given database with the
+// connection flags from o. Like psqlCmd, args must already be quoted.
+func pgDumpCmd(dbName string, o Options, args ...string) string {
+	o = o.normalize()
+	return fmt.Sprintf("%s %s -h %s -p %d -U %s %s %s",
+		pgEnv(o), quote(o.PgDumpPath), o.DBHost, o.DBPort, o.DBUser, dbName, strings.Join(args, " "))
+}
+
+// pgEnv returns the environment variables for psql and pg_dump, to be
+// prefixed to the command.
+func pgEnv(o Options) string {
+	var env []string
+	if !o.UsePassFile {
+		env = append(env, "PGPASSWORD="+quote(o.DBPassword))
+	}
+	if opts := connOptions(o); opts != "" {
+		env = append(env, "PGOPTIONS="+quote(opts))
+	}
+	return strings.Join(env, " ")
+}
+
+// passFileMount is where the pgpass file is mounted in the container.
+const passFileMount = "/tmp/postdock.pgpass"
+
+// pgpassEntry returns the line of a pgpass file with the credentials of o.
+func pgpassEntry(o Options) string {
+	o = o.normalize()
+	host := o.DBHost
+	// Unix socket connections match localhost.
+	if isSocket(host) {
+		host = "localhost"
+	}
+	esc := strings.NewReplacer(`\`, `\\`, ":", `\:`)
+	return strings.Join([]string{
+		esc.Replace(host), strconv.Itoa(o.DBPort), "*", esc.Replace(o.DBUser), esc.Replace(o.DBPassword),
+	}, ":")
+}
+
+// writePassFile writes the pgpass file for o to a new temporary file, which
+// the caller must remove.
+func writePassFile(o Options) (string, error) {
+	f, err := ioutil.TempFile("", "postdock-*.pgpass")
+	if err != nil {
+		return "", err
+	}
+	entries := append([]string{pgpassEntry(o)}, o.passFileEntries...)
+	_, err = f.WriteString(strings.Join(entries, "\n") + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	// TempFile creates files with 0600, which libpq requires.
+	return f.Name(), nil
+}
+
+// connOptions returns the server settings for every session in the format
+// of PGOPTIONS, e.g. "-c statement_timeout=5000". Passing them on connect
+// ensures they apply to the same session as the work itself.
+func connOptions(o Options) string {
+	var opts []string
+	if o.StatementTimeout > 0 {
+		opts = append(opts, fmt.Sprintf("-c statement_timeout=%d", o.StatementTimeout.Milliseconds()))
+	}
+	if o.readOnlySession {
+		opts = append(opts, "-c default_transaction_read_only=on")
+	}
+	return strings.Join(opts, " ")
+}
+
+// execQuery runs a query against dbName for its side effects, with psql or
+// if configured over database/sql.
+func execQuery(dbName string, query string, o Options) (string, error) {
+	if o.SQLDriver != "" {
+		return withBusyRetries(o, func() (string, error) {
+			return "", sqlExec(dbName, query, o)
+		})
+	}
+	return run(psql(dbName, query, o), o)
+}
+
+// isDuplicate reports whether err is postgres refusing to create an object
+// which already exists, i.e. duplicate_database (42P04) or duplicate_object
+// (42710). psql only reports the message, drivers usually the code as well.
+// A truly simultaneous create may instead hit the unique index of the catalog.
+func isDuplicate(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "already exists") ||
+		strings.Contains(msg, "42P04") ||
+		strings.Contains(msg, "42710") ||
+		strings.Contains(msg, "pg_database_datname_index") ||
+		strings.Contains(msg, "pg_authid_rolname_index")
+}
+
+// isPermissionError reports whether err is postgres refusing an operation for
+// lack of privileges, e.g. "must be a superuser to terminate superuser process".
+func isPermissionError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "permission denied") ||
+		strings.Contains(msg, "must be a superuser") ||
+		strings.Contains(msg, "must be a member of the role")
+}
+
+// quoteIdent quotes a possibly schema qualified identifier, e.g. audit.events
+// becomes "audit"."events".
+func quoteIdent(name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = `"` + strings.ReplaceAll(p, `"`, `""`) + `"`
+	}
+	return strings.Join(parts, ".")
+}
+
+// quoteLiteral quotes s as a sql string literal, doubling any single quotes.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// quote returns s as a shell word, single-quoted unless it is made of safe
+// characters only. Unlike a double-quoted string, the shell does not expand
+// anything inside it, e.g. $1 or $$ in function bodies are passed to psql as is.
+func quote(s string) string {
+	if safeWord.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+// RunCommand runs command through the same wrapper as every other function:
+// directly when inside a docker container, otherwise in a container of
+// DockerImage with DockerNetwork, Volumes and the like. It is an escape hatch
+// for what this package does not model, e.g. pg_isready or a one-off script,
+// and returns the trimmed output.
+//
+// command is run by Shell with PGHOST, PGPORT, PGUSER and PGPASSWORD (unless
+// UsePassFile is set) in its environment, so the postgres tools connect
+// without flags. The caller is responsible for quoting: command is passed to
+// the shell as is, so never build it from untrusted input. Like other errors,
+// a failure is redacted and truncated to MaxErrorOutput.
+func RunCommand(command string, opt Options) (_ string, err error) {
+	defer trace("RunCommand", "", &opt)(&err)
+
+	if err := opt.isValid("postgres"); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(command) == "" {
+		return "", errors.New("postdock: required option: command")
+	}
+
+	o := opt.normalize()
+	env := fmt.Sprintf("PGHOST=%s PGPORT=%d PGUSER=%s", quote(o.DBHost), o.DBPort, quote(o.DBUser))
+	if e := pgEnv(o); e != "" {
+		env += " " + e
+	}
+	// Exported, so they also apply to every command of a script.
+	return run("export "+env+"; "+command, opt)
+}
+
+// safeWord matches strings which need no quoting in sh, e.g. psql or
+// /usr/bin/pg_dump.
+var safeWord = regexp.MustCompile(`^[a-zA-Z0-9_./:@%+,-]+$`)
+
+// run runs cmd, either directly when inside a docker container or in a new
+// container of o.DockerImage. volumes are bind mounted into that container.
+func run(cmd string, o Options, volumes ...string) (string, error) {
+	return runInput(cmd, nil, o, volumes...)
+}
 
-		out, err := p.String()
+// runInput is like run but passes input, if not nil, to cmd's stdin.
+func runInput(cmd string, input io.Reader, o Options, volumes ...string) (out string, err error) {
+	if h, ok := o.Hook.(CommandHook); ok && !o.DryRun {
+		defer func(start time.Time) {
+			redacted := redact(cmd, o)
+			h.OnCommand(CommandEvent{
+				Op:       o.op,
+				DBName:   o.dbName,
+				Name:     commandName(redacted),
+				Command:  redacted,
+				Duration: time.Since(start),
+				Err:      err,
+			})
+		}(time.Now())
+	}
+	passFile := "<pgpass file>"
+	if o.UsePassFile && !o.DryRun {
+		f, err := writePassFile(o)
 		if err != nil {
 			return "", err
 		}
+		defer os.Remove(f)
+		passFile = f
+	}
 
-		return strings.TrimSpace(out), nil
+	// Inside a docker container we expect the command name to be available.
+	if o.local() {
+		if o.UsePassFile {
+			cmd = "PGPASSFILE=" + quote(passFile) + " " + cmd
+		}
+		if o.DryRun {
+			log.Printf("dry run:\n%s", redact(cmd, o))
+			return "", nil
+		}
+		return execute(cmd, input, o)
 	}
 
+	if !o.DryRun {
+		if _, err := exec.LookPath("docker"); err != nil {
+			return "", fmt.Errorf("%w: install docker, or set ForceLocal to run psql and pg_dump directly: %v",
+				ErrDockerNotInstalled, err)
+		}
+	}
 	// Pull the image silently.
-	if err := dockerPull(o.DockerImage); err != nil {
+	if err := dockerPull(o.DockerImage, o); err != nil {
 		return "", err
 	}
 
-	var network string
+	flags := []string{"--rm"}
+	if o.CopyFiles {
+		// Removed by runCopied, after copying the files back.
+		flags = nil
+	}
+	if o.KeepContainer {
+		flags = nil
+	}
+	if o.Platform != "" {
+		flags = append(flags, "--platform="+o.Platform)
+	}
+	if o.ShmSize != "" {
+		flags = append(flags, "--shm-size="+o.ShmSize)
+	}
+	// Label every container, so CleanupContainers can find leftovers.
+	flags = append(flags, "--label "+containerLabel, "--label "+runLabel)
+	if input != nil {
+		flags = append(flags, "--interactive")
+	}
+	if o.ContainerName != "" {
+		flags = append(flags, "--name "+quote(o.ContainerName))
+	}
 	if o.DockerNetwork != "" {
-		network = fmt.Sprintf("--network=%s", o.DockerNetwork)
+		flags = append(flags, "--network="+quote(o.DockerNetwork))
+	}
+	if o.NetworkAlias != "" {
+		flags = append(flags, "--network-alias="+quote(o.NetworkAlias))
+	}
+	if o.Hostname != "" {
+		flags = append(flags, "--hostname="+quote(o.Hostname))
+	}
+	// Getuid returns -1 on platforms without user ids, e.g. windows.
+	if o.RunAsCurrentUser && os.Getuid() >= 0 {
+		flags = append(flags, fmt.Sprintf("--user %d:%d", os.Getuid(), os.Getgid()))
+	}
+	if o.Workdir != "" {
+		flags = append(flags, fmt.Sprintf("--workdir=%s", quote(o.Workdir)))
+	}
+	var copies []copyPath
+	if o.UsePassFile {
+		flags = append(flags, "--env PGPASSFILE="+passFileMount)
+		if o.CopyFiles {
+			copies = append(copies, copyPath{host: passFile, container: passFileMount})
+		} else {
+			flags = append(flags, "--volume "+quote(passFile+":"+passFileMount+":ro"))
+		}
+	}
+	mounts := len(o.Volumes)
+	if !o.CopyFiles {
+		mounts += len(volumes)
+		if o.UsePassFile {
+			mounts++
+		}
+	}
+	if mounts > 0 && !o.DryRun {
+		// Fail clearly, rather than with psql not finding the file because the
+		// remote daemon mounted an empty directory.
+		if host, remote := remoteDocker(o); remote {
+			return "", fmt.Errorf("%w: docker host is %s", ErrRemoteDocker, host)
+		}
+	}
+	for _, v := range volumes {
+		if o.Workdir != "" && !strings.Contains(v, ":"+workspaceMount+"/") {
+			// Mount relative to the working directory instead of /, where
+			// commands look for the files.
+			i := strings.LastIndex(v, ":/")
+			v = v[:i+1] + path.Join(o.Workdir, v[i+1:])
+		}
+		if o.CopyFiles {
+			copies = append(copies, splitVolume(v))
+			continue
+		}
+		// The working directory may contain spaces and the like.
+		flags = append(flags, "--volume "+quote(v))
+	}
+	for _, v := range o.Volumes {
+		flags = append(flags, "--volume "+quote(v))
+	}
+	// psql connects through the socket file in the directory, so it must be
+	// available at the same path inside the container.
+	if isSocket(o.DBHost) {
+		flags = append(flags, "--volume "+quote(o.DBHost+":"+o.DBHost))
+	}
+	if o.CopyFiles {
+		out, err = runCopied(flags, copies, cmd, input, o)
+	} else {
+		// docker run [OPTIONS] IMAGE [COMMAND] [ARG...]
+		e := fmt.Sprintf("docker run %s %s %s -c %s",
+			strings.Join(flags, " "), o.DockerImage, quote(o.normalize().Shell), quote(cmd))
+
+		if o.DryRun {
+			log.Printf("dry run:\n%s", redact(e, o))
+			return "", nil
+		}
+		if o.Debug {
+			logCommand(e, flags, nil, o)
+		}
+
+		out, err = execute(e, input, o)
+	}
+	if err != nil {
+		if derr := daemonError(err.Error()); derr != nil {
+			return "", derr
+		}
+		return "", err
+	}
+	return out, nil
+}
+
+// logCommand logs the docker command e, started with flags, at Debug as
+// key=value fields, e.g. to grep for the commands of one operation, with
+// the passwords redacted. copies are the paths copied by runCopied, if any.
+// The operation is the innermost one running it.
+func logCommand(e string, flags []string, copies []copyPath, o Options) {
+	var volumes []string
+	for _, f := range flags {
+		if strings.HasPrefix(f, "--volume ") {
+			volumes = append(volumes, strings.TrimPrefix(f, "--volume "))
+		}
 	}
-	var vol string
-	if o.dockerVolume != "" {
-		vol = fmt.Sprintf("--volume %s", o.dockerVolume)
+	for _, c := range copies {
+		volumes = append(volumes, "copy:"+c.host+":"+c.container)
 	}
-	// docker run [OPTIONS] IMAGE [COMMAND] [ARG...]
-	e := fmt.Sprintf("docker run --rm %s %s %s sh -c %q",
-		network, vol, o.DockerImage, cmd)
+	op := o.op
+	if op == "" {
+		op = "-"
+	}
+	log.Printf("docker command: op=%s runtime=docker image=%s network=%q volumes=%q cmd=%q",
+		op, o.DockerImage, o.DockerNetwork, strings.Join(volumes, ","), redact(e, o))
+}
 
-	if o.Debug {
-		log.Printf("raw docker command:\n%s", e)
+// envAssignment matches an environment variable assignment before a
+// command, e.g. PGPASSWORD=secret.
+var envAssignment = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*=`)
+
+// commandName returns the base name of the program cmd runs, skipping the
+// environment variables set before it, e.g. psql for
+// "PGPASSWORD='********' /usr/bin/psql -h db ...".
+func commandName(cmd string) string {
+	var word strings.Builder
+	var q byte
+	started := false
+	for i := 0; i <= len(cmd); i++ {
+		if i == len(cmd) || q == 0 && strings.IndexByte(" \t\n", cmd[i]) >= 0 {
+			if started {
+				if w := word.String(); !envAssignment.MatchString(w) {
+					return path.Base(w)
+				}
+				word.Reset()
+				started = false
+			}
+			continue
+		}
+		switch c := cmd[i]; {
+		case q != 0 && c == q:
+			q = 0
+		case q == 0 && (c == '\'' || c == '"'):
+			q = c
+		default:
+			word.WriteByte(c)
+		}
+		started = true
 	}
+	return ""
+}
 
-	p := script.Exec(e)
-	n := p.ExitStatus()
-	if n > 0 {
-		p.SetError(nil)
-		out, _ := p.String()
-		return "", fmt.Errorf("raw error: %s", out)
+// daemonError returns ErrDockerDaemonUnavailable if out is the docker CLI
+// failing to reach the daemon, or nil otherwise.
+func daemonError(out string) error {
+	msg := strings.ToLower(out)
+	if strings.Contains(msg, "cannot connect to the docker daemon") ||
+		strings.Contains(msg, "is the docker daemon running") ||
+		strings.Contains(msg, "error during connect") {
+		return fmt.Errorf("%w: start docker or check DOCKER_HOST and the docker context: %s",
+			ErrDockerDaemonUnavailable, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// rawError returns the error for a failed command with output out, which is
+// redacted and truncated to o.MaxErrorOutput.
+func rawError(out string, o Options) error {
+	o = o.normalize()
+	out = redact(out, o)
+	if o.MaxErrorOutput > 0 && len(out) > o.MaxErrorOutput {
+		out = truncate(out, o.MaxErrorOutput)
+	}
+	return fmt.Errorf("raw error: %s", out)
+}
+
+// execute runs command and returns its trimmed output, see shell. Without
+// input, it is retried according to o.BusyRetries.
+func execute(command string, input io.Reader, o Options) (string, error) {
+	if input != nil {
+		out, err := executeOnce(command, input, o)
+		return out, busyError(err)
+	}
+	return withBusyRetries(o, func() (string, error) {
+		return executeOnce(command, nil, o)
+	})
+}
+
+// busyMessages are errors of the server refusing a connection for lack of
+// connection slots.
+var busyMessages = []string{
+	"too many clients already",
+	"remaining connection slots are reserved",
+	"too many connections for role",
+	"too many connections for database",
+}
+
+// busyError returns err wrapped in ErrServerBusy if the server is out of
+// connection slots or shared memory, otherwise err as is.
+func busyError(err error) error {
+	if err == nil || errors.Is(err, ErrServerBusy) {
+		return err
+	}
+	if isRefusedBusy(err) || strings.Contains(err.Error(), "out of shared memory") {
+		return fmt.Errorf("%w: %v", ErrServerBusy, err)
+	}
+	return err
+}
+
+// isRefusedBusy reports whether err is the server refusing a connection for
+// lack of connection slots.
+func isRefusedBusy(err error) bool {
+	msg := err.Error()
+	for _, s := range busyMessages {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// withBusyRetries calls f, and again up to o.BusyRetries times with an
+// exponential backoff while the server refuses the connection as busy.
+func withBusyRetries(o Options, f func() (string, error)) (string, error) {
+	backoff := o.BusyBackoff
+	if backoff <= 0 {
+		backoff = 500 * time.Millisecond
+	}
+	out, err := f()
+	for i := 0; i < o.BusyRetries && err != nil && isRefusedBusy(err); i++ {
+		if !o.deadline.IsZero() && time.Now().Add(backoff).After(o.deadline) {
+			break
+		}
+		if o.Debug {
+			log.Printf("server busy, retrying in %s: %v", backoff, err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		out, err = f()
 	}
+	return out, busyError(err)
+}
 
-	out, err := p.String()
+// executeOnce implements execute without retries.
+func executeOnce(command string, input io.Reader, o Options) (string, error) {
+	defer func(start time.Time) { o.Metrics.addCommand(time.Since(start)) }(time.Now())
+
+	out, failed, err := shell(command, input, o)
 	if err != nil {
 		return "", err
 	}
+	if failed {
+		return "", rawError(out, o)
+	}
+	if err := checkIgnoredErrors(out, o); err != nil {
+		return "", err
+	}
 
 	return strings.TrimSpace(out), nil
 }
 
-func dockerPull(imageName string) error {
-	p := script.Exec("docker pull -q " + imageName)
-	if p.ExitStatus() > 0 {
-		p.SetError(nil)
-		out, _ := p.String()
+// verboseError matches an error in psql's verbose output, e.g.
+// "ERROR:  42710: extension "x" already exists", capturing the SQLSTATE.
+var verboseError = regexp.MustCompile(`(?m)ERROR:\s+([0-9A-Z]{5}):`)
+
+// checkIgnoredErrors returns an error if o.IgnoreErrors is set and out, the
+// output of a command that completed, has an error not listed there.
+func checkIgnoredErrors(out string, o Options) error {
+	if len(o.IgnoreErrors) == 0 {
+		return nil
+	}
+	for _, m := range verboseError.FindAllStringSubmatch(out, -1) {
+		ignored := false
+		for _, code := range o.IgnoreErrors {
+			if strings.HasPrefix(m[1], code) {
+				ignored = true
+				break
+			}
+		}
+		if !ignored {
+			return rawError(out, o)
+		}
+	}
+	return nil
+}
+
+// containerLabel is set on every container started by this package, and
+// runLabel as well to tell apart those of the current process, e.g. from
+// those of a concurrent CI job on the same docker host.
+const containerLabel = "postdock=true"
+
+var runLabel = fmt.Sprintf("postdock.run=%d-%d", os.Getpid(), time.Now().UnixNano())
+
+// CleanupContainers removes the containers started by this package which are
+// still around, e.g. because of KeepContainer or because the process was
+// killed. Useful as a deterministic teardown for test suites. Containers of
+// the current process are removed in any state, those of other processes only
+// once they exited, so a concurrent process keeps its running containers.
+func CleanupContainers(opt Options) (err error) {
+	defer trace("CleanupContainers", "", &opt)(&err)
+
+	if opt.local() {
+		return nil
+	}
+
+	lists := []string{
+		"docker ps --all --quiet --filter label=" + runLabel,
+		"docker ps --all --quiet --filter label=" + containerLabel + " --filter status=exited",
+	}
+	if opt.DryRun {
+		for _, list := range lists {
+			log.Printf("dry run:\n%s", list)
+		}
+		return nil
+	}
+	var ids []string
+	seen := make(map[string]bool)
+	for _, list := range lists {
+		out, failed, err := dockerCLI(list, nil, opt)
+		if err != nil {
+			return err
+		}
+		if failed {
+			return fmt.Errorf("raw error: %s", out)
+		}
+		for _, id := range strings.Fields(out) {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	out, failed, err := dockerCLI("docker rm --force "+strings.Join(ids, " "), nil, opt)
+	if err != nil {
+		return err
+	}
+	if failed {
 		return fmt.Errorf("raw error: %s", out)
 	}
+	if opt.Debug {
+		log.Printf("removed %d containers", len(ids))
+	}
+
+	return nil
+}
+
+// remoteDocker reports whether the docker CLI talks to a daemon on another
+// machine, either through DOCKER_HOST or the current docker context, and
+// returns its address.
+func remoteDocker(o Options) (string, bool) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		out, failed, err := dockerCLI("docker context inspect --format '{{.Endpoints.docker.Host}}'", nil, o)
+		if err != nil || failed {
+			return "", false
+		}
+		host = strings.TrimSpace(out)
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return host, false
+	}
+	switch u.Scheme {
+	case "tcp", "ssh", "http", "https":
+		h := u.Hostname()
+		return host, h != "localhost" && h != "127.0.0.1" && h != "::1"
+	}
+	// unix:// and npipe:// are always local.
+	return host, false
+}
+
+func dockerPull(imageName string, o Options) error {
+	pull := "docker pull -q " + imageName
+	if o.Platform != "" {
+		pull = "docker pull -q --platform=" + o.Platform + " " + imageName
+	}
+	if o.DryRun {
+		log.Printf("dry run:\n%s", pull)
+		return nil
+	}
+	defer func(start time.Time) { o.Metrics.addPull(time.Since(start)) }(time.Now())
+
+	switch o.PullPolicy {
+	case PullNever:
+		return nil
+	case PullIfNotPresent:
+		// Inspecting a digest reference only succeeds for an image with that digest.
+		out, failed, err := dockerCLI("docker image inspect --format '{{.Os}}/{{.Architecture}}' "+imageName, nil, o)
+		if err != nil {
+			return err
+		}
+		if !failed {
+			// A local image of another platform is pulled again, ignoring
+			// the variant, e.g. v8 of linux/arm64/v8, which is not reported.
+			if o.Platform == "" || strings.HasPrefix(o.Platform+"/", strings.TrimSpace(out)+"/") {
+				return nil
+			}
+		}
+	}
+	if o.RegistryAuth != nil {
+		if err := dockerLogin(imageName, o); err != nil {
+			return err
+		}
+	}
+	out, failed, err := dockerCLI(pull, nil, o)
+	if err != nil {
+		return err
+	}
+	if failed {
+		return pullError(out)
+	}
+
+	return nil
+}
+
+func dockerLogin(imageName string, o Options) error {
+	server := o.RegistryAuth.Server
+	if server == "" {
+		server = registryHost(imageName)
+	}
+	login := "docker login -u " + quote(o.RegistryAuth.Username) + " --password-stdin"
+	if server != "" {
+		login += " " + quote(server)
+	}
+	// Pass the password on stdin so it does not show up in the process list.
+	out, failed, err := dockerCLI(login, strings.NewReader(o.RegistryAuth.Password), o)
+	if err != nil {
+		return err
+	}
+	if failed {
+		return fmt.Errorf("%w: docker login %s: %s", ErrRegistryAuth, server, redact(out, o))
+	}
 
 	return nil
 }
+
+// registryHost returns the registry part of an image reference, or an empty
+// string for Docker Hub images such as postgres:12 or library/postgres:12.
+func registryHost(imageName string) string {
+	i := strings.Index(imageName, "/")
+	if i < 0 {
+		return ""
+	}
+	host := imageName[:i]
+	if strings.ContainsAny(host, ".:") || host == "localhost" {
+		return host
+	}
+	return ""
+}
+
+// pullError turns the output of a failed docker pull into an error,
+// recognizing the common authentication and missing image failures.
+func pullError(out string) error {
+	if err := daemonError(out); err != nil {
+		return err
+	}
+	msg := strings.ToLower(out)
+	switch {
+	case strings.Contains(msg, "unauthorized"),
+		strings.Contains(msg, "authentication required"),
+		strings.Contains(msg, "access denied"):
+		// Docker Hub reports private and missing repositories alike as "pull
+		// access denied", so this may also mean the image does not exist.
+		return fmt.Errorf("%w: %s", ErrRegistryAuth, out)
+	case strings.Contains(msg, "manifest unknown"),
+		strings.Contains(msg, "not found"):
+		return fmt.Errorf("%w: %s", ErrImageNotFound, out)
+	}
+	return fmt.Errorf("raw error: %s", out)
+}
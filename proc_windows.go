@@ -0,0 +1,12 @@
+package postdock
+
+import "os/exec"
+
+// setProcessGroup is a no-op on windows, where killProcess only kills cmd
+// itself.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcess kills cmd.
+func killProcess(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
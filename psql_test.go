@@ -0,0 +1,106 @@
+package postdock
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// noPsqlrc matches the start of a psql command with --no-psqlrc right after
+// the connection flags.
+var noPsqlrc = regexp.MustCompile(`/opt/pg/bin/psql -h \S+ -d \S+ -U \S+ -p \d+ --no-psqlrc `)
+
+// TestNoPsqlrc checks that every psql command ignores ~/.psqlrc, which could
+// change the output format the package parses.
+func TestNoPsqlrc(t *testing.T) {
+	dir := t.TempDir()
+	sqlFile := filepath.Join(dir, "001_init.sql")
+	if err := ioutil.WriteFile(sqlFile, []byte("SELECT 1;\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ops := map[string]func(opt Options) error{
+		"Create": func(opt Options) error { return Create("db", opt) },
+		"Drop":   func(opt Options) error { return Drop("db", opt) },
+		"Exists": func(opt Options) error {
+			// Nothing exists in DryRun mode.
+			if err := Exists("db", opt); !errors.Is(err, ErrDBNotExist) {
+				return err
+			}
+			return nil
+		},
+		"ResetMany":  func(opt Options) error { return ResetMany([]string{"a", "b"}, opt) },
+		"Import":     func(opt Options) error { return Import("db", sqlFile, opt) },
+		"ApplySQL":   func(opt Options) error { _, err := ApplySQL("db", "SELECT 1", opt); return err },
+		"Exec":       func(opt Options) error { _, err := Exec("db", []string{"SELECT 1"}, opt); return err },
+		"Query":      func(opt Options) error { _, _, err := Query("db", "SELECT 1", opt); return err },
+		"QueryJSON":  func(opt Options) error { _, err := QueryJSON("db", "SELECT 1", opt); return err },
+		"CountRows":  func(opt Options) error { _, err := CountRows("db", "t", opt); return err },
+		"Terminate":  func(opt Options) error { return Terminate("db", opt) },
+		"EnsureRole": func(opt Options) error { return EnsureRole("reader", "", RoleAttrs{}, opt) },
+		"CopyDatabase": func(opt Options) error {
+			return CopyDatabase("src", opt, "dst", opt)
+		},
+		"Authenticate":  func(opt Options) error { return Authenticate(opt) },
+		"ServerVersion": func(opt Options) error { _, err := ServerVersion(opt); return err },
+	}
+	for name, op := range ops {
+		for _, local := range []bool{true, false} {
+			opt := testOptions()
+			opt.ForceLocal, opt.ForceDocker = local, !local
+			opt.PsqlPath = "/opt/pg/bin/psql"
+			out := dryRun(t, op, opt)
+			n := strings.Count(out, opt.PsqlPath)
+			if n == 0 {
+				t.Errorf("%s: no psql command:\n%s", name, out)
+			}
+			if m := len(noPsqlrc.FindAllString(out, -1)); m != n {
+				t.Errorf("%s: %d of %d psql commands lack --no-psqlrc:\n%s", name, n-m, n, out)
+			}
+		}
+	}
+}
+
+// hostilePsqlrc fakes a psql reading a ~/.psqlrc which turns on \timing and
+// prints a banner, unless --no-psqlrc is passed.
+const hostilePsqlrc = `psqlrc=1
+for arg; do
+	[ "$arg" = --no-psqlrc ] && psqlrc=
+	last=$arg
+done
+[ -n "$psqlrc" ] && echo "Timing is on."
+case "$*" in
+*"FROM pg_database"*) printf 'exists\nt\n(1 row)\n' ;;
+*"count(*)"*) printf 'count\n42\n(1 row)\n' ;;
+*--csv*) printf 'id,name\n1,a\n'; echo "${last#\\echo }" ;;
+esac
+[ -n "$psqlrc" ] && echo "Time: 0.215 ms"
+exit 0`
+
+func TestHostilePsqlrc(t *testing.T) {
+	opt := testOptions()
+	opt.PsqlPath = fakeScript(t, "psql", hostilePsqlrc)
+
+	if err := Exists("db", opt); err != nil {
+		t.Errorf("Exists: %v", err)
+	}
+	n, err := CountRows("db", "t", opt)
+	if err != nil || n != 42 {
+		t.Errorf("CountRows = %d, %v, want 42", n, err)
+	}
+	columns, rows, err := Query("db", "SELECT id, name FROM t", opt)
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if strings.Join(columns, ",") != "id,name" || len(rows) != 1 || rows[0][1].String != "a" {
+		t.Errorf("Query = %q, %+v", columns, rows)
+	}
+
+	// The fake does misbehave without --no-psqlrc.
+	out, _, err := shell(quote(opt.PsqlPath)+" -c 'SELECT count(*) FROM t'", nil, opt)
+	if err != nil || !strings.Contains(out, "Timing is on.") {
+		t.Errorf("fake psql ignored the missing --no-psqlrc: %q, %v", out, err)
+	}
+}
@@ -0,0 +1,173 @@
+package postdock
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// QueryJSON runs query against dbName and returns its rows as a JSON array of
+// objects keyed by column name, ready to be unmarshaled into a slice of
+// structs. A query without rows returns an empty array. The query is used as
+// a subquery, so it must be a single SELECT (or VALUES) statement.
+func QueryJSON(dbName string, query string, opt Options) (_ []byte, err error) {
+	defer trace("QueryJSON", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return nil, err
+	}
+	query = strings.TrimRight(strings.TrimSpace(query), ";")
+	if query == "" {
+		return nil, errors.New("postdock: required option: query")
+	}
+
+	// json_agg returns NULL instead of an empty array for no rows.
+	q := fmt.Sprintf("SELECT coalesce(json_agg(t), '[]'::json) FROM (%s) t", query)
+	out, err := queryScalar(dbName, q, opt.reader())
+	if err != nil {
+		return nil, err
+	}
+	if opt.DryRun {
+		return []byte("[]"), nil
+	}
+
+	return []byte(out), nil
+}
+
+// QueryFormat is the output format of QueryRaw.
+type QueryFormat int
+
+const (
+	// QueryCSV is psql's --csv output, which quotes values containing the
+	// separator, quotes or newlines. Requires psql 12 or later.
+	QueryCSV QueryFormat = iota
+	// QueryUnaligned is psql's -A output, with QueryOptions.FieldSeparator
+	// between values, by default |. Values are not escaped.
+	QueryUnaligned
+	// QueryAligned is psql's default table output, for humans.
+	QueryAligned
+)
+
+// QueryOptions configures the output of QueryRaw.
+type QueryOptions struct {
+	Format QueryFormat
+	// FieldSeparator separates values in QueryUnaligned output.
+	FieldSeparator string
+	// TuplesOnly leaves out the header and footer, see psql -t.
+	TuplesOnly bool
+}
+
+// QueryRaw runs query against dbName and returns psql's output formatted
+// according to qopt, by default as CSV with a header line.
+func QueryRaw(dbName string, query string, qopt QueryOptions, opt Options) (_ string, err error) {
+	defer trace("QueryRaw", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(query) == "" {
+		return "", errors.New("postdock: required option: query")
+	}
+
+	var args []string
+	switch qopt.Format {
+	case QueryCSV:
+		args = append(args, "--csv")
+	case QueryUnaligned:
+		args = append(args, "-A")
+		if qopt.FieldSeparator != "" {
+			args = append(args, "-F", quote(qopt.FieldSeparator))
+		}
+	case QueryAligned:
+	default:
+		return "", fmt.Errorf("postdock: invalid query format: %d", qopt.Format)
+	}
+	if qopt.TuplesOnly {
+		args = append(args, "-t")
+	}
+	args = append(args, "-c", quote(query))
+
+	opt = opt.reader()
+	return run(psqlCmd(dbName, opt, args...), opt)
+}
+
+// Query runs query against dbName and returns the column names and the rows,
+// parsed from psql's CSV output, which handles values containing commas,
+// quotes, tabs or newlines, though encoding/csv reads a \r\n within a value as
+// \n. NULL values are returned as invalid sql.NullString, telling them apart
+// from empty strings. query should be a single statement returning rows, such
+// as a SELECT. Requires psql 12 or later.
+func Query(dbName string, query string, opt Options) (_ []string, _ [][]sql.NullString, err error) {
+	defer trace("Query", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return nil, nil, err
+	}
+	if strings.TrimSpace(query) == "" {
+		return nil, nil, errors.New("postdock: required option: query")
+	}
+
+	// psql prints NULL like an empty string unless told otherwise, and the
+	// output is trimmed, which would also trim trailing spaces of the last
+	// value. A random marker for NULL, and an end marker after the output,
+	// avoid both.
+	token, err := randomToken()
+	if err != nil {
+		return nil, nil, err
+	}
+	null, end := "null-"+token, "end-"+token
+	opt = opt.reader()
+	cmd := psqlCmd(dbName, opt, "--csv", "-P", quote("null="+null),
+		"-c", quote(query), "-c", quote(`\echo `+end))
+	out, err := run(cmd, opt)
+	if err != nil || opt.DryRun {
+		return nil, nil, err
+	}
+	return parseQueryOutput(out, null, end)
+}
+
+// parseQueryOutput parses the CSV output of Query, where null marks NULL
+// values and end the end of the output.
+func parseQueryOutput(out, null, end string) ([]string, [][]sql.NullString, error) {
+	i := strings.LastIndex(out, "\n"+end)
+	if i < 0 && out != end {
+		return nil, nil, fmt.Errorf("postdock: unexpected query output: %q", out)
+	}
+	if i < 0 {
+		return nil, nil, nil
+	}
+	out = out[:i]
+
+	records, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("postdock: parsing query output: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, nil, nil
+	}
+	rows := make([][]sql.NullString, 0, len(records)-1)
+	for _, rec := range records[1:] {
+		row := make([]sql.NullString, len(rec))
+		for j, v := range rec {
+			if v != null {
+				row[j] = sql.NullString{String: v, Valid: true}
+			}
+		}
+		rows = append(rows, row)
+	}
+	return records[0], rows, nil
+}
+
+// randomToken returns a random hex string, e.g. for markers in output which
+// must not collide with data.
+func randomToken() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
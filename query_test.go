@@ -0,0 +1,85 @@
+package postdock
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseQueryOutputRoundTrip(t *testing.T) {
+	const null, end = "null-0123", "end-0123"
+	tests := []struct {
+		name    string
+		columns []string
+		rows    [][]sql.NullString
+	}{
+		{"no rows", []string{"id"}, [][]sql.NullString{}},
+		{"plain", []string{"id", "name"}, [][]sql.NullString{
+			{{String: "1", Valid: true}, {String: "a", Valid: true}},
+		}},
+		{"tabs", []string{"v"}, [][]sql.NullString{
+			{{String: "a\tb", Valid: true}},
+			{{String: "\t", Valid: true}},
+		}},
+		{"newlines", []string{"v", "w"}, [][]sql.NullString{
+			{{String: "line 1\nline 2", Valid: true}, {String: "\n", Valid: true}},
+			{{String: "a,\"b\"\nc", Valid: true}, {String: "x", Valid: true}},
+		}},
+		{"nulls", []string{"v", "w"}, [][]sql.NullString{
+			{{}, {String: "", Valid: true}},
+			{{String: "NULL", Valid: true}, {}},
+		}},
+		{"trailing spaces", []string{"v"}, [][]sql.NullString{
+			{{String: "a", Valid: true}},
+			{{String: "last  ", Valid: true}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			w := csv.NewWriter(&b)
+			if err := w.Write(tt.columns); err != nil {
+				t.Fatal(err)
+			}
+			for _, row := range tt.rows {
+				rec := make([]string, len(row))
+				for i, v := range row {
+					rec[i] = v.String
+					if !v.Valid {
+						rec[i] = null
+					}
+				}
+				if err := w.Write(rec); err != nil {
+					t.Fatal(err)
+				}
+			}
+			w.Flush()
+			// As executeOnce trims the output of psql.
+			out := strings.TrimSpace(b.String() + end + "\n")
+
+			columns, rows, err := parseQueryOutput(out, null, end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(columns, tt.columns) {
+				t.Errorf("columns = %q, want %q", columns, tt.columns)
+			}
+			if !reflect.DeepEqual(rows, tt.rows) {
+				t.Errorf("rows = %+v, want %+v", rows, tt.rows)
+			}
+		})
+	}
+}
+
+func TestParseQueryOutputEmpty(t *testing.T) {
+	// A statement without rows, e.g. an UPDATE, prints only the end marker.
+	columns, rows, err := parseQueryOutput("end-0123", "null-0123", "end-0123")
+	if err != nil || columns != nil || rows != nil {
+		t.Errorf("got %q, %+v, %v, want nothing", columns, rows, err)
+	}
+	if _, _, err := parseQueryOutput("ERROR", "null-0123", "end-0123"); err == nil {
+		t.Error("no error for output without the end marker")
+	}
+}
@@ -0,0 +1,52 @@
+package postdock
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactByStructure(t *testing.T) {
+	for _, local := range []bool{true, false} {
+		opt := testOptions()
+		opt.ForceLocal = local
+		opt.ForceDocker = !local
+		opt.DBUser = "app"
+		opt.DBPassword = "it's postgres"
+		opt.AdminUser = "postgres"
+		opt.AdminPassword = "postgres"
+		out := dryRun(t, func(opt Options) error { return CreateRole(opt) }, opt)
+
+		for _, secret := range []string{"it's", "'postgres'", "=postgres"} {
+			if strings.Contains(out, secret) {
+				t.Errorf("local=%t: output contains %q:\n%s", local, secret, out)
+			}
+		}
+		for _, want := range []string{"-U postgres", "PGPASSWORD=", "PASSWORD "} {
+			if !strings.Contains(out, want) {
+				t.Errorf("local=%t: output lost %q:\n%s", local, want, out)
+			}
+		}
+		if !local && !strings.Contains(out, "postgres:16-alpine") {
+			t.Errorf("output lost the image name:\n%s", out)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	opt := Options{DBPassword: "postgres"}
+	tests := []struct {
+		in, want string
+	}{
+		{"PGPASSWORD=postgres psql -U postgres", "PGPASSWORD=******** psql -U postgres"},
+		{"CREATE USER postgres WITH PASSWORD 'postgres';", "CREATE USER postgres WITH PASSWORD '********';"},
+		{"ALTER ROLE x password 'postgres'", "ALTER ROLE x password '********'"},
+		{`sh -c 'PGPASSWORD='"'"'postgres'"'"' psql'`, `sh -c 'PGPASSWORD='"'"'********'"'"' psql'`},
+		{"FATAL:  password authentication failed for user \"postgres\"", "FATAL:  password authentication failed for user \"postgres\""},
+		{"nothing secret", "nothing secret"},
+	}
+	for _, tt := range tests {
+		if got := redact(tt.in, opt); got != tt.want {
+			t.Errorf("redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
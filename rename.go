@@ -0,0 +1,69 @@
+package postdock
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ErrDBInUse is returned by RenameDatabase when sessions connect to the
+// database while it is being renamed.
+var ErrDBInUse = errors.New("database is in use")
+
+// RenameDatabase renames oldName to newName, after terminating the sessions
+// of both, e.g. to swap a freshly imported db_new into place as db once the
+// old db was dropped. newName must not exist.
+func RenameDatabase(oldName string, newName string, opt Options) (err error) {
+	defer trace("RenameDatabase", oldName, &opt)(&err)
+
+	if err := opt.isValid(oldName); err != nil {
+		return err
+	}
+	if newName == "" {
+		return errors.New("postdock: required option: new db name")
+	}
+	if oldName == newName {
+		return fmt.Errorf("postdock: cannot rename db %s to itself", oldName)
+	}
+	// The maintenance database is where the rename runs from.
+	if oldName == "postgres" {
+		return errors.New("postdock: cannot rename the maintenance database postgres")
+	}
+
+	if err := Exists(oldName, opt); err != nil && !opt.DryRun {
+		return err
+	}
+	if !opt.SkipTerminate {
+		for _, name := range []string{oldName, newName} {
+			err := Terminate(name, opt)
+			switch {
+			case errors.Is(err, ErrTerminatePermission):
+				// Still attempt the rename, it only fails if the database is in use.
+				if opt.Debug {
+					log.Printf("continuing to rename db:%s: %v", oldName, err)
+				}
+			case err != nil:
+				return err
+			}
+		}
+	}
+
+	q := fmt.Sprintf("ALTER DATABASE %s RENAME TO %s;", oldName, newName)
+	out, err := execQuery("postgres", q, opt.admin())
+	switch {
+	case err == nil:
+	case isDuplicate(err):
+		return fmt.Errorf("postdock: cannot rename db %s: %s already exists", oldName, newName)
+	case strings.Contains(err.Error(), "is being accessed by other users"):
+		return fmt.Errorf("%s: %w: %v", oldName, ErrDBInUse, err)
+	default:
+		return err
+	}
+
+	if opt.Debug {
+		log.Printf("[%s]: renamed db:%s to %s", out, oldName, newName)
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package postdock
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ResetMany drops and re-creates each of dbNames, like Drop followed by Create,
+// but in a single psql session. Create and Drop run several commands each, and
+// outside of a container each of them starts a new one. Besides checking the
+// roles, ResetMany runs a single command regardless of the number of
+// databases, e.g. 2 instead of 90 for 10 databases, see BenchmarkResetMany for
+// the time it takes against a given server. It requires psql 10 or later.
+//
+// Unlike Create, the databases are always re-created, also if they exist.
+func ResetMany(dbNames []string, opt Options) (err error) {
+	defer trace("ResetMany", strings.Join(dbNames, ","), &opt)(&err)
+
+	if len(dbNames) == 0 {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, name := range dbNames {
+		if err := opt.isValid(name); err != nil {
+			return err
+		}
+		if seen[name] {
+			return fmt.Errorf("postdock: duplicate db name: %s", name)
+		}
+		seen[name] = true
+		names = append(names, quoteLiteral(name))
+	}
+	if err := createRoles(opt); err != nil {
+		return err
+	}
+	adm := opt.admin()
+	owner := adm.normalize().DBOwner
+
+	// CREATE and DROP DATABASE can not run in a transaction, so each is a
+	// statement of its own in the script. The grants need a connection to
+	// each database, which \connect opens within the same session.
+	var script strings.Builder
+	if !opt.SkipTerminate {
+		fmt.Fprintf(&script, "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname IN (%s) AND pid <> pg_backend_pid();\n",
+			strings.Join(names, ", "))
+	}
+	for _, name := range dbNames {
+		fmt.Fprintf(&script, "DROP DATABASE IF EXISTS %s;\n", name)
+	}
+	// Only the grants depend on the server version, query it in the
+	// session rather than starting another container.
+	script.WriteString("SELECT current_setting('server_version_num')::int >= 150000 AS pg15 \\gset\n")
+	for _, name := range dbNames {
+		script.WriteString(createDatabaseQuery(name, adm) + "\n")
+		for _, q := range settingsQueries(name, adm) {
+			script.WriteString(q + ";\n")
+		}
+		fmt.Fprintf(&script, "\\connect %s\n", name)
+		for _, q := range schemaQueries(owner, opt) {
+			script.WriteString(q + ";\n")
+		}
+		if opt.SkipGrants {
+			continue
+		}
+		script.WriteString("\\if :pg15\n")
+		script.WriteString(strings.Join(grantQueries(grantSchemas(opt), owner, grantCreators(opt), 150000), ";\n") + ";\n")
+		script.WriteString("\\else\n")
+		script.WriteString(strings.Join(grantQueries(grantSchemas(opt), owner, grantCreators(opt), 0), ";\n") + ";\n")
+		script.WriteString("\\endif\n")
+	}
+
+	out, err := runInput(psqlCmd("postgres", adm, "--file=-"), strings.NewReader(script.String()), adm)
+	if err != nil {
+		return createDatabaseError(err, adm)
+	}
+	if opt.Debug {
+		log.Printf("[%s]: successfully reset %d databases", out, len(dbNames))
+	}
+
+	return nil
+}
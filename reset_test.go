@@ -0,0 +1,60 @@
+package postdock
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// BenchmarkResetMany compares ResetMany with Drop and Create of each
+// database, reporting the number of commands, i.e. of containers started
+// when not running in one. By default psql is faked, set
+// POSTDOCK_TEST_OPTIONS to the path of an Options JSON file to measure
+// against a real server, e.g.
+//
+//	POSTDOCK_TEST_OPTIONS=testdb.json go test -run - -bench ResetMany
+func BenchmarkResetMany(b *testing.B) {
+	opt := testOptions()
+	opt.PsqlPath = fakeServerPsql(b, b.TempDir())
+	if path := os.Getenv("POSTDOCK_TEST_OPTIONS"); path != "" {
+		var err error
+		if opt, err = LoadOptions(path); err != nil {
+			b.Fatal(err)
+		}
+	}
+	names := make([]string, 10)
+	for i := range names {
+		names[i] = fmt.Sprintf("postdock_bench_%d", i)
+	}
+	defer func() {
+		for _, name := range names {
+			_ = Drop(name, opt)
+		}
+	}()
+
+	b.Run("ResetMany", func(b *testing.B) {
+		opt := opt
+		opt.Metrics = &Metrics{}
+		for i := 0; i < b.N; i++ {
+			if err := ResetMany(names, opt); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(opt.Metrics.Snapshot().Commands)/float64(b.N), "commands/op")
+	})
+	b.Run("DropCreate", func(b *testing.B) {
+		opt := opt
+		opt.Metrics = &Metrics{}
+		for i := 0; i < b.N; i++ {
+			for _, name := range names {
+				if err := Drop(name, opt); err != nil {
+					b.Fatal(err)
+				}
+				if err := Create(name, opt); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(opt.Metrics.Snapshot().Commands)/float64(b.N), "commands/op")
+	})
+}
@@ -0,0 +1,131 @@
+package postdock
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// RoleAttrs are the attributes EnsureRole gives a role.
+type RoleAttrs struct {
+	// Login allows the role to log in, like a user created by Create.
+	Login bool
+	// CreateDB and CreateRole allow the role to create databases and roles.
+	CreateDB   bool
+	CreateRole bool
+	// ConnectionLimit is the maximum number of concurrent connections of the
+	// role, 0 means no limit.
+	ConnectionLimit int
+}
+
+// EnsureRole creates role with password and attrs, or if it exists, alters it
+// to match them, so running it repeatedly converges to the same role. An
+// existing role is only altered if one of attrs differs or password is set,
+// since the current password cannot be compared. An empty password leaves the
+// password of an existing role unchanged and creates a role without one.
+// Like Create, it connects as the admin role, if any.
+func EnsureRole(role string, password string, attrs RoleAttrs, opt Options) (err error) {
+	defer trace("EnsureRole", "", &opt)(&err)
+
+	if err := opt.isValid("postgres"); err != nil {
+		return err
+	}
+	if role == "" {
+		return errors.New("postdock: required option: role")
+	}
+	if attrs.ConnectionLimit < 0 {
+		return fmt.Errorf("postdock: invalid connection limit: %d", attrs.ConnectionLimit)
+	}
+
+	adm := opt.admin()
+	if password != "" {
+		adm.secrets = append(append([]string(nil), adm.secrets...), password)
+	}
+
+	q := fmt.Sprintf(`SELECT coalesce((SELECT concat_ws('|', rolcanlogin::text, rolcreatedb::text, rolcreaterole::text, rolconnlimit)
+FROM pg_catalog.pg_roles WHERE rolname = %s), '');`, quoteLiteral(role))
+	out, err := queryScalar("postgres", q, adm)
+	if err != nil {
+		return err
+	}
+
+	stmt := "CREATE ROLE"
+	if out != "" {
+		current, err := parseRoleAttrs(out)
+		if err != nil {
+			return err
+		}
+		if current == attrs && password == "" {
+			if opt.Debug {
+				log.Printf("skipping altering role:%s, it is up to date", role)
+			}
+			return nil
+		}
+		stmt = "ALTER ROLE"
+	}
+	q = fmt.Sprintf("%s %s WITH %s;", stmt, quoteName(role), roleAttrsClause(attrs))
+	if password != "" {
+		q = strings.TrimSuffix(q, ";") + " PASSWORD " + quoteLiteral(password) + ";"
+	}
+	out, err = execQuery("postgres", q, adm)
+	if isDuplicate(err) {
+		// Created concurrently by someone else since the check above, run
+		// again to alter it instead.
+		return EnsureRole(role, password, attrs, opt)
+	}
+	if err != nil {
+		return err
+	}
+	if opt.Debug {
+		log.Printf("[%s]: successfully ensured role:%s", out, role)
+	}
+
+	return nil
+}
+
+// quoteName quotes a single identifier, e.g. a role or table name. Unlike
+// quoteIdent, a dot is part of the name.
+func quoteName(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// roleAttrsClause returns the options of CREATE ROLE and ALTER ROLE for a.
+func roleAttrsClause(a RoleAttrs) string {
+	attr := func(set bool, name string) string {
+		if set {
+			return name
+		}
+		return "NO" + name
+	}
+	limit := a.ConnectionLimit
+	if limit == 0 {
+		limit = -1
+	}
+	return fmt.Sprintf("%s %s %s CONNECTION LIMIT %d",
+		attr(a.Login, "LOGIN"), attr(a.CreateDB, "CREATEDB"), attr(a.CreateRole, "CREATEROLE"), limit)
+}
+
+// parseRoleAttrs parses the attributes queried by EnsureRole, e.g.
+// "true|false|false|-1".
+func parseRoleAttrs(s string) (RoleAttrs, error) {
+	fields := strings.Split(s, "|")
+	if len(fields) != 4 {
+		return RoleAttrs{}, fmt.Errorf("postdock: unexpected role attributes: %q", s)
+	}
+	var a RoleAttrs
+	var err error
+	for i, p := range []*bool{&a.Login, &a.CreateDB, &a.CreateRole} {
+		if *p, err = strconv.ParseBool(fields[i]); err != nil {
+			return RoleAttrs{}, fmt.Errorf("postdock: unexpected role attributes %q: %w", s, err)
+		}
+	}
+	if a.ConnectionLimit, err = strconv.Atoi(fields[3]); err != nil {
+		return RoleAttrs{}, fmt.Errorf("postdock: unexpected role attributes %q: %w", s, err)
+	}
+	if a.ConnectionLimit < 0 {
+		a.ConnectionLimit = 0
+	}
+	return a, nil
+}
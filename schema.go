@@ -0,0 +1,110 @@
+package postdock
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// DumpSchema dumps a single schema of dbName, e.g. the schema of one tenant,
+// with its data to output as a plain sql script, for ImportSchema. Ownership
+// and privileges are left out, since the roles of the source database may not
+// exist where the schema is imported. Like Dump, output may be relative or
+// absolute.
+func DumpSchema(dbName string, schema string, output string, opt Options) (err error) {
+	defer trace("DumpSchema", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return err
+	}
+	if schema == "" {
+		return errors.New("postdock: required option: schema")
+	}
+	if output == "" {
+		return errors.New("postdock: required option: output file")
+	}
+
+	file, vol, err := mountFile(output, opt)
+	if err != nil {
+		return err
+	}
+	args := []string{
+		"--schema=" + quote(quoteIdent(schema)),
+		"--no-owner", "--no-privileges",
+		"--file=" + quote(file),
+	}
+	if _, err := run(pgDumpCmd(dbName, opt, args...), opt.bounded(), vol); err != nil {
+		return versionMismatchError(err, opt)
+	}
+
+	if opt.Debug {
+		log.Printf("successfully dumped schema:%s of db:%s to %s", schema, dbName, output)
+	}
+
+	return nil
+}
+
+// ImportSchema applies a dump written by DumpSchema to the existing database
+// dbName. If newSchema is set and differs from the dumped schema, the dump is
+// rewritten to create its objects in newSchema instead, e.g. to clone one
+// tenant into another. The target schema must not exist yet. The objects are
+// owned by DBUser.
+//
+// The rewrite replaces the schema name where pg_dump uses it: in CREATE
+// SCHEMA and as the qualifier of object names, quoted or not. Since pg_dump
+// qualifies every name, this covers dumps of tables, views and sequences, but
+// not references inside function bodies that rely on search_path, and it also
+// rewrites matching text in string literals.
+func ImportSchema(dbName string, file string, schema string, newSchema string, opt Options) (err error) {
+	defer trace("ImportSchema", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return err
+	}
+	if file == "" {
+		return errors.New("postdock: required option: sql file to import")
+	}
+	if schema == "" {
+		return errors.New("postdock: required option: schema")
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	sql := string(b)
+	if newSchema != "" && newSchema != schema {
+		sql = renameSchema(sql, schema, newSchema)
+	}
+	if _, err := applyInput(dbName, strings.NewReader(sql), opt); err != nil {
+		// psql only knows it read from stdin.
+		var ierr *ImportError
+		if errors.As(err, &ierr) {
+			ierr.File = file
+		}
+		return err
+	}
+
+	if opt.Debug {
+		log.Printf("successfully imported schema:%s into db:%s as %s", schema, dbName, newSchema)
+	}
+
+	return nil
+}
+
+// renameSchema rewrites the schema from to to in a plain dump, see
+// ImportSchema.
+func renameSchema(sql string, from string, to string) string {
+	name := regexp.QuoteMeta(from) + `|` + regexp.QuoteMeta(quoteIdent(from))
+	to = quoteIdent(to)
+	// A bare identifier is only the schema if not part of a longer one, e.g.
+	// renaming app must leave myapp.users alone.
+	qualifier := regexp.MustCompile(`(^|[^\w"$.])(?:` + name + `)\.`)
+	sql = qualifier.ReplaceAllString(sql, "${1}"+strings.ReplaceAll(to, "$", "$$")+".")
+	// CREATE SCHEMA, COMMENT ON SCHEMA, ALTER DEFAULT PRIVILEGES IN SCHEMA
+	// and the like.
+	statement := regexp.MustCompile(`(SCHEMA\s+)(?:` + name + `)([\s;])`)
+	return statement.ReplaceAllString(sql, "${1}"+strings.ReplaceAll(to, "$", "$$")+"${2}")
+}
@@ -0,0 +1,83 @@
+package postdock
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ResetSequences sets the sequences of all serial and identity columns of
+// dbName to continue after the largest value of their column, e.g. after
+// loading data with COPY or INSERTs with explicit ids, which leave them
+// behind and make the next insert fail with a duplicate key. The sequence of
+// an empty table is reset to its start value. It returns the number of
+// sequences reset. Requires postgres 10 or later.
+func ResetSequences(dbName string, opt Options) (_ int, err error) {
+	defer trace("ResetSequences", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return 0, err
+	}
+
+	return resetSequences(dbName, "", opt)
+}
+
+// ResetTableSequences is like ResetSequences for the columns of a single
+// table, which may be schema qualified, e.g. users or audit.events.
+func ResetTableSequences(dbName string, table string, opt Options) (_ int, err error) {
+	defer trace("ResetTableSequences", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return 0, err
+	}
+	if table == "" {
+		return 0, errors.New("postdock: required option: table")
+	}
+
+	return resetSequences(dbName, table, opt)
+}
+
+// resetSequences resets the sequences of table, or of all tables if empty.
+// The setval statements are generated by a query and run by \gexec, in a
+// single psql session.
+func resetSequences(dbName string, table string, opt Options) (int, error) {
+	where := "tn.nspname NOT IN ('pg_catalog', 'information_schema')"
+	if table != "" {
+		where = fmt.Sprintf("t.oid = %s::regclass", quoteLiteral(quoteIdent(table)))
+	}
+	// Serial columns own their sequence (deptype a), identity columns
+	// (deptype i) as well.
+	q := fmt.Sprintf(`SELECT format('SELECT setval(%%L, coalesce(max(%%I), %%s), max(%%I) IS NOT NULL) FROM %%I.%%I;',
+	quote_ident(sn.nspname) || '.' || quote_ident(s.relname), a.attname, ps.seqstart, a.attname, tn.nspname, t.relname)
+FROM pg_catalog.pg_depend d
+JOIN pg_catalog.pg_class s ON s.oid = d.objid AND s.relkind = 'S'
+JOIN pg_catalog.pg_namespace sn ON sn.oid = s.relnamespace
+JOIN pg_catalog.pg_sequence ps ON ps.seqrelid = s.oid
+JOIN pg_catalog.pg_class t ON t.oid = d.refobjid
+JOIN pg_catalog.pg_namespace tn ON tn.oid = t.relnamespace
+JOIN pg_catalog.pg_attribute a ON a.attrelid = t.oid AND a.attnum = d.refobjsubid
+WHERE d.classid = 'pg_catalog.pg_class'::regclass AND d.refclassid = 'pg_catalog.pg_class'::regclass
+	AND d.deptype IN ('a', 'i') AND %s
+ORDER BY 1
+\gexec
+`, where)
+
+	out, err := runInput(psqlCmd(dbName, opt, "-A", "-t", "--file=-"), strings.NewReader(q), opt)
+	if err != nil || opt.DryRun {
+		return 0, err
+	}
+	// One line with the new value per sequence.
+	var n int
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) != "" {
+			n++
+		}
+	}
+
+	if opt.Debug {
+		log.Printf("successfully reset %d sequences of db:%s", n, dbName)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,90 @@
+package postdock
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// sqlOpen opens a connection to dbName with o.SQLDriver. A new pool is opened
+// for every call since each operation may target a different database.
+func sqlOpen(dbName string, o Options) (*sql.DB, error) {
+	db, err := sql.Open(o.SQLDriver, o.URL(dbName))
+	if err != nil {
+		return nil, fmt.Errorf("postdock: open %s: %w", o.SQLDriver, err)
+	}
+	return db, nil
+}
+
+// sqlExec is the database/sql counterpart of running a query with psql.
+func sqlExec(dbName string, query string, o Options) error {
+	if o.DryRun {
+		log.Printf("dry run (%s on db:%s):\n%s", o.SQLDriver, dbName, redact(query, o))
+		return nil
+	}
+	db, err := sqlOpen(dbName, o)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if o.Debug {
+		log.Printf("raw %s query on db:%s:\n%s", o.SQLDriver, dbName, redact(query, o))
+	}
+	ctx, cancel := o.context()
+	defer cancel()
+	if _, err := db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("postdock: %s: %w", o.SQLDriver, err)
+	}
+	return nil
+}
+
+// sqlQueryScalar is the database/sql counterpart of queryScalar.
+func sqlQueryScalar(dbName string, query string, o Options) (string, error) {
+	if o.DryRun {
+		log.Printf("dry run (%s on db:%s):\n%s", o.SQLDriver, dbName, redact(query, o))
+		return "", nil
+	}
+	db, err := sqlOpen(dbName, o)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	if o.Debug {
+		log.Printf("raw %s query on db:%s:\n%s", o.SQLDriver, dbName, redact(query, o))
+	}
+	ctx, cancel := o.context()
+	defer cancel()
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return "", fmt.Errorf("postdock: %s: %w", o.SQLDriver, err)
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+	if len(cols) != 1 {
+		return "", fmt.Errorf("postdock: query returned %d columns, expected 1", len(cols))
+	}
+	var (
+		n     int
+		value sql.NullString
+	)
+	for rows.Next() {
+		if err := rows.Scan(&value); err != nil {
+			return "", err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("postdock: %s: %w", o.SQLDriver, err)
+	}
+	if n != 1 {
+		return "", fmt.Errorf("postdock: query returned %d rows, expected 1", n)
+	}
+
+	return value.String, nil
+}
@@ -0,0 +1,173 @@
+package postdock
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// shell runs command with sh and returns its combined output, passing input,
+// if not nil, to its stdin. Each line is passed to o.OnOutput, if set, as soon
+// as it is written rather than when the command exits. failed reports a
+// command which exited with an error, its output then usually explains why.
+// err is set if the command could not run, or was killed because the deadline
+// of the operation passed, see Options.Timeout.
+func shell(command string, input io.Reader, o Options) (out string, failed bool, err error) {
+	ctx, cancel := o.context()
+	defer cancel()
+	r, w := io.Pipe()
+	// Let sh parse command, which may start with environment variables.
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = input
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if !o.deadline.IsZero() {
+		// Killing sh alone would leave psql or the docker client running.
+		setProcessGroup(cmd)
+	}
+	if err := cmd.Start(); err != nil {
+		return "", false, err
+	}
+	done := make(chan error, 1)
+	exited := make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		close(exited)
+		w.Close()
+		done <- err
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = killProcess(cmd)
+		case <-exited:
+		}
+	}()
+
+	b := outputBuffer{}
+	if o.boundOutput {
+		b.limit = o.normalize().MaxErrorOutput
+	}
+	// A bufio.Reader rather than a Scanner, which gives up on lines longer
+	// than its buffer, e.g. a long INSERT of a pg_dump.
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			line = redact(strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), o)
+			if o.OnOutput != nil {
+				o.OnOutput(line)
+			}
+			b.writeLine(line)
+		}
+		if err != nil {
+			// Only io.EOF, the pipe is closed with nil once the command exited.
+			break
+		}
+	}
+
+	if err := <-done; err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", false, fmt.Errorf("postdock: command killed, the operation exceeded its timeout of %s: %w", o.Timeout, ctx.Err())
+		}
+		if _, ok := err.(*exec.ExitError); ok {
+			return b.String(), true, nil
+		}
+		return "", false, err
+	}
+	return b.String(), false, nil
+}
+
+// outputBuffer collects the output of a command line by line. With a limit,
+// once the output grows beyond it only its beginning and end are kept, with a
+// marker in between, so a command printing a huge output does not exhaust
+// memory. The rows of the command tags are counted for the marker, so
+// newResult still counts all of them.
+type outputBuffer struct {
+	limit int
+
+	head []byte
+	// tail is a ring buffer of the last bytes written, continuing at next
+	// once it is full.
+	tail    []byte
+	next    int
+	dropped int64
+	rows    int64
+}
+
+// writeLine appends line and a newline.
+func (b *outputBuffer) writeLine(line string) {
+	if b.limit <= 0 {
+		b.head = append(append(b.head, line...), '\n')
+		return
+	}
+	if m := commandTag.FindStringSubmatch(line); m != nil {
+		n, _ := strconv.ParseInt(m[1], 10, 64)
+		b.rows += n
+	}
+	s := line + "\n"
+	half := b.limit / 2
+	if n := half - len(b.head); n > 0 {
+		if n > len(s) {
+			n = len(s)
+		}
+		b.head = append(b.head, s[:n]...)
+		s = s[n:]
+	}
+	size := b.limit - half
+	if n := size - len(b.tail); n > 0 {
+		if n > len(s) {
+			n = len(s)
+		}
+		b.tail = append(b.tail, s[:n]...)
+		s = s[n:]
+	}
+	for len(s) > 0 {
+		n := copy(b.tail[b.next:], s)
+		b.dropped += int64(n)
+		b.next = (b.next + n) % size
+		s = s[n:]
+	}
+}
+
+// String returns the output, at most limit bytes of it including the marker.
+func (b *outputBuffer) String() string {
+	if b.dropped == 0 {
+		return string(b.head) + string(b.tail)
+	}
+	tail := string(b.tail[b.next:]) + string(b.tail[:b.next])
+	marker := fmt.Sprintf("\n[truncated %d bytes, %d rows affected in total]\n", b.dropped, b.rows)
+	if n := b.limit - len(b.head) - len(marker); n < len(tail) && n >= 0 {
+		tail = tail[len(tail)-n:]
+	}
+	return string(b.head) + marker + tail
+}
+
+// truncate returns what an outputBuffer with limit keeps of s.
+func truncate(s string, limit int) string {
+	b := outputBuffer{limit: limit}
+	for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		b.writeLine(line)
+	}
+	return b.String()
+}
+
+// dockerCLI runs a docker command of its own, e.g. docker pull, rather than
+// one of the client tools, so its output is not passed to o.OnOutput.
+func dockerCLI(command string, input io.Reader, o Options) (string, bool, error) {
+	o.OnOutput = nil
+	return shell(command, input, o)
+}
+
+// context returns the context for a command of the operation o belongs to,
+// which ends at its deadline, if any.
+func (o Options) context() (context.Context, context.CancelFunc) {
+	if o.deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), o.deadline)
+}
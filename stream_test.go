@@ -0,0 +1,55 @@
+package postdock
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestOutputBufferBounded(t *testing.T) {
+	b := outputBuffer{limit: 1000}
+	for i := 0; i < 10000; i++ {
+		b.writeLine(fmt.Sprintf("INSERT 0 %d", i%3))
+	}
+	b.writeLine("ERROR:  the end")
+	out := b.String()
+	if len(out) > 1000 {
+		t.Fatalf("output has %d bytes, want at most 1000", len(out))
+	}
+	if !strings.HasPrefix(out, "INSERT 0 0\nINSERT 0 1\n") {
+		t.Errorf("output lost its beginning: %q", out[:40])
+	}
+	if !strings.HasSuffix(out, "ERROR:  the end\n") {
+		t.Errorf("output lost its end: %q", out[len(out)-40:])
+	}
+	if r := newResult(out); r.RowsAffected != 9999 {
+		t.Errorf("RowsAffected = %d, want 9999", r.RowsAffected)
+	}
+}
+
+func TestOutputBufferUnbounded(t *testing.T) {
+	var b outputBuffer
+	for i := 0; i < 100; i++ {
+		b.writeLine("INSERT 0 1")
+	}
+	if out := b.String(); out != strings.Repeat("INSERT 0 1\n", 100) {
+		t.Errorf("unexpected output %q", out)
+	}
+	b = outputBuffer{limit: 1000}
+	b.writeLine("short")
+	if out := b.String(); out != "short\n" {
+		t.Errorf("output = %q, want %q", out, "short\n")
+	}
+}
+
+func TestShellLongLine(t *testing.T) {
+	const n = 2 << 20
+	out, failed, err := shell(fmt.Sprintf("head -c %d /dev/zero | tr '\\0' a; echo; echo tail", n), nil, Options{})
+	if err != nil || failed {
+		t.Fatalf("failed=%t err=%v", failed, err)
+	}
+	if want := strings.Repeat("a", n) + "\ntail\n"; out != want {
+		t.Errorf("got %d bytes ending in %q, want %d bytes ending in %q",
+			len(out), out[strings.LastIndexByte(out, 'a')+1:], len(want), "\ntail\n")
+	}
+}
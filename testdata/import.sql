@@ -0,0 +1 @@
+INSERT INTO t VALUES (1);
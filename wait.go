@@ -0,0 +1,150 @@
+package postdock
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// ErrNotReady is returned by WaitReady when the probe did not succeed in
+// time.
+var ErrNotReady = errors.New("server not ready")
+
+// WaitOptions configures WaitReady.
+type WaitOptions struct {
+	// Query is the probe, defaults to SELECT 1. The server is ready once it
+	// succeeds and returns anything but no rows or false, e.g. SELECT
+	// to_regclass('users') IS NOT NULL to wait for a table.
+	Query string
+	// DBName is the database to run Query in, defaults to postgres. While it
+	// does not exist, the probe is retried.
+	DBName string
+	// Timeout is how long to wait in total, defaults to 30s.
+	Timeout time.Duration
+	// Interval is the pause between attempts, defaults to 1s.
+	Interval time.Duration
+	// RetryQueryErrors retries when Query itself fails, e.g. because a table
+	// it reads does not exist yet. By default only failures to connect are
+	// retried and any other error is returned right away.
+	RetryQueryErrors bool
+}
+
+// WaitReady polls the server with a probe query until it succeeds, e.g.
+// after starting a container, to wait for the application to be ready rather
+// than just for the server to accept connections like pg_isready does. Once
+// wopt.Timeout passes, it returns ErrNotReady wrapping the last error.
+func WaitReady(wopt WaitOptions, opt Options) (err error) {
+	if wopt.DBName == "" {
+		wopt.DBName = "postgres"
+	}
+	defer trace("WaitReady", wopt.DBName, &opt)(&err)
+
+	return waitReady(wopt, opt)
+}
+
+// waitReady implements WaitReady for wopt with a DBName.
+func waitReady(wopt WaitOptions, opt Options) error {
+	if err := opt.isValid(wopt.DBName); err != nil {
+		return err
+	}
+	if wopt.Query == "" {
+		wopt.Query = "SELECT 1;"
+	}
+	if wopt.Timeout <= 0 {
+		wopt.Timeout = 30 * time.Second
+	}
+	if wopt.Interval <= 0 {
+		wopt.Interval = time.Second
+	}
+
+	deadline := time.Now().Add(wopt.Timeout)
+	for attempt := 1; ; attempt++ {
+		out, err := run(psql(wopt.DBName, wopt.Query, opt.reader()), opt)
+		if opt.DryRun {
+			return err
+		}
+		switch {
+		case err == nil && out != "" && out != "f" && out != "false":
+			if opt.Debug {
+				log.Printf("db:%s ready after %d attempts", wopt.DBName, attempt)
+			}
+			return nil
+		case err == nil:
+			err = fmt.Errorf("probe returned %q", out)
+		case !wopt.RetryQueryErrors && !isConnectionError(err):
+			return err
+		}
+		if time.Now().Add(wopt.Interval).After(deadline) {
+			return fmt.Errorf("postdock: %w after %s: %v", ErrNotReady, wopt.Timeout, err)
+		}
+		if opt.Debug {
+			log.Printf("db:%s not ready, attempt %d: %v", wopt.DBName, attempt, err)
+		}
+		time.Sleep(wopt.Interval)
+	}
+}
+
+// isConnectionError reports whether err is psql failing to connect, or the
+// server not accepting connections yet, rather than a failing query.
+func isConnectionError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{
+		"could not connect to server",
+		"connection refused",
+		"could not translate host name",
+		"no such host",
+		"timeout expired",
+		"server closed the connection unexpectedly",
+		"the database system is starting up",
+		"the database system is shutting down",
+		"the database system is in recovery mode",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	// The database of the probe is not created yet.
+	return strings.Contains(msg, "database") && strings.Contains(msg, "does not exist")
+}
+
+// ExtensionAvailable reports whether the extension ext can be created in
+// dbName, i.e. is listed in pg_available_extensions, e.g. to check for
+// postgis before importing a schema using it. Note an extension needing
+// shared_preload_libraries, such as timescaledb, is listed even if not
+// preloaded.
+func ExtensionAvailable(dbName string, ext string, opt Options) (_ bool, err error) {
+	defer trace("ExtensionAvailable", dbName, &opt)(&err)
+
+	if err := opt.isValid(dbName); err != nil {
+		return false, err
+	}
+	if ext == "" {
+		return false, errors.New("postdock: required option: extension")
+	}
+
+	out, err := queryScalar(dbName, extensionQuery(ext), opt.reader())
+	if err != nil {
+		return false, err
+	}
+	return parseBool(out, opt)
+}
+
+// WaitForExtension is like WaitReady, polling until the extension ext is
+// available in dbName, see ExtensionAvailable. The Query and DBName of wopt
+// are ignored.
+func WaitForExtension(dbName string, ext string, wopt WaitOptions, opt Options) (err error) {
+	defer trace("WaitForExtension", dbName, &opt)(&err)
+
+	if ext == "" {
+		return errors.New("postdock: required option: extension")
+	}
+	wopt.DBName = dbName
+	wopt.Query = extensionQuery(ext)
+	return waitReady(wopt, opt)
+}
+
+func extensionQuery(ext string) string {
+	return fmt.Sprintf("SELECT EXISTS ( SELECT name FROM pg_catalog.pg_available_extensions WHERE name = %s);", quoteLiteral(ext))
+}